@@ -3,8 +3,10 @@ package client
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/big"
 	"net/http"
 	"net/http/cookiejar"
@@ -86,10 +88,10 @@ func (c *Client) Register(email, password string) error {
 		// 2. 获取验证码图片
 		code, err := c.solveCaptcha()
 		if err != nil {
-			fmt.Printf("  attempt %d: captcha OCR failed: %v, retrying...\n", i+1, err)
+			slog.Info("captcha OCR failed, retrying", "attempt", i+1, "err", err)
 			continue
 		}
-		fmt.Printf("  attempt %d: captcha recognized as '%s'\n", i+1, code)
+		slog.Debug("captcha recognized", "attempt", i+1, "code", code)
 
 		// 3. 提交注册
 		form := url.Values{
@@ -121,7 +123,7 @@ func (c *Client) Register(email, password string) error {
 
 		// 验证码错误 → 重试
 		if strings.Contains(bodyStr, "验证码") {
-			fmt.Printf("  attempt %d: captcha incorrect, retrying...\n", i+1)
+			slog.Info("captcha incorrect, retrying", "attempt", i+1)
 			continue
 		}
 
@@ -296,6 +298,11 @@ func DownloadSubscriptionYAML(subURL string) ([]byte, error) {
 	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Get(subURL)
 	if err != nil {
+		// *url.Error repeats the URL, which carries the subscription token.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
 		return nil, fmt.Errorf("download subscription: %w", err)
 	}
 	defer resp.Body.Close()
@@ -0,0 +1,337 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// dialTimeout bounds outbound TCP dials, DNS lookup included.
+const dialTimeout = 10 * time.Second
+
+func addACLFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("allow", nil, "destinations clients may reach even if private: CIDRs or domains (a domain covers its subdomains)")
+	cmd.Flags().StringSlice("deny", nil, "destinations clients may not reach: CIDRs or domains")
+	cmd.Flags().Bool("allow-private", false, "let clients reach loopback, private, link-local and other non-public addresses")
+	cmd.Flags().String("acl", "", `JSON file with "allow", "deny", "allow_private", "client_allow" and per-port overrides under "ports"`)
+}
+
+// aclRules is one level of rules as written in the ACL file. ClientAllow
+// restricts who may connect rather than where to; see clientGuard.
+type aclRules struct {
+	Allow        []string `json:"allow,omitempty"`
+	Deny         []string `json:"deny,omitempty"`
+	AllowPrivate *bool    `json:"allow_private,omitempty"`
+	ClientAllow  []string `json:"client_allow,omitempty"`
+}
+
+// aclFile is the --acl file. Rules under "ports" apply to clients of that
+// listening port and take precedence over the top-level ones:
+//
+//	{"deny": ["example.com"], "ports": {"51802": {"allow": ["10.0.0.0/8"]}}}
+type aclFile struct {
+	aclRules
+	Ports map[string]aclRules `json:"ports,omitempty"`
+}
+
+// loadACLFile reads the command's --acl file; without one it returns an
+// empty file.
+func loadACLFile(cmd *cobra.Command) (*aclFile, error) {
+	path, _ := cmd.Flags().GetString("acl")
+	file := &aclFile{}
+	if path == "" {
+		return file, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for key := range file.Ports {
+		if port, err := strconv.Atoi(key); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%s: invalid port %q", path, key)
+		}
+	}
+	return file, nil
+}
+
+// destACLFromFlags builds a command's destination policy from its flags.
+func destACLFromFlags(cmd *cobra.Command) (*destACL, error) {
+	allow, _ := cmd.Flags().GetStringSlice("allow")
+	deny, _ := cmd.Flags().GetStringSlice("deny")
+	allowPrivate, _ := cmd.Flags().GetBool("allow-private")
+
+	file, err := loadACLFile(cmd)
+	if err != nil {
+		return nil, err
+	}
+	file.Allow = append(file.Allow, allow...)
+	file.Deny = append(file.Deny, deny...)
+	if cmd.Flags().Changed("allow-private") {
+		file.AllowPrivate = &allowPrivate
+	}
+
+	global, err := newDestPolicy(file.aclRules, nil)
+	if err != nil {
+		return nil, err
+	}
+	a := &destACL{global: global, ports: make(map[int]*destPolicy)}
+	for key, rules := range file.Ports {
+		port, _ := strconv.Atoi(key) // checked by loadACLFile
+		if a.ports[port], err = newDestPolicy(rules, global); err != nil {
+			return nil, fmt.Errorf("port %d: %w", port, err)
+		}
+	}
+	return a, nil
+}
+
+// destACL holds the destination policy of one command.
+type destACL struct {
+	global *destPolicy
+	ports  map[int]*destPolicy
+}
+
+// Port returns the policy for clients of a listening port. A nil *destACL
+// yields a nil policy, which allows everything.
+func (a *destACL) Port(port int) *destPolicy {
+	if a == nil {
+		return nil
+	}
+	if p, ok := a.ports[port]; ok {
+		return p
+	}
+	return a.global
+}
+
+// destPolicy decides which destinations clients may reach. Rules are looked
+// up from the most specific level (a port) to the global one; the first
+// level with a matching rule decides, deny before allow. Destinations no
+// rule matches are allowed unless they are non-public addresses.
+type destPolicy struct {
+	parent       *destPolicy
+	allowNets    []netip.Prefix
+	denyNets     []netip.Prefix
+	allowDomains []string
+	denyDomains  []string
+	allowPrivate *bool // nil = inherit; default false
+}
+
+func newDestPolicy(r aclRules, parent *destPolicy) (*destPolicy, error) {
+	p := &destPolicy{parent: parent, allowPrivate: r.AllowPrivate}
+	var err error
+	if p.allowNets, p.allowDomains, err = parseACLEntries(r.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if p.denyNets, p.denyDomains, err = parseACLEntries(r.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return p, nil
+}
+
+// parseACLEntries splits rule entries into CIDRs (a bare IP is a /32 or
+// /128) and domains.
+func parseACLEntries(entries []string) ([]netip.Prefix, []string, error) {
+	var nets []netip.Prefix
+	var domains []string
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if pfx, err := netip.ParsePrefix(e); err == nil {
+			nets = append(nets, pfx.Masked())
+			continue
+		}
+		if ip, err := netip.ParseAddr(e); err == nil {
+			nets = append(nets, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		if strings.ContainsAny(e, "/:") {
+			return nil, nil, fmt.Errorf("invalid CIDR or domain %q", e)
+		}
+		domains = append(domains, strings.TrimPrefix(strings.TrimSuffix(e, "."), "*."))
+	}
+	return nets, domains, nil
+}
+
+// ACL verdicts of one level.
+const (
+	aclNoMatch = iota
+	aclAllow
+	aclDeny
+)
+
+// verdict matches host (a domain, or "" for an IP literal) and ip (invalid
+// if not yet resolved) against this level's rules.
+func (p *destPolicy) verdict(host string, ip netip.Addr) int {
+	if matchDomain(p.denyDomains, host) || matchNets(p.denyNets, ip) {
+		return aclDeny
+	}
+	if matchDomain(p.allowDomains, host) || matchNets(p.allowNets, ip) {
+		return aclAllow
+	}
+	return aclNoMatch
+}
+
+func matchDomain(domains []string, host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNets(nets []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns "" if host/ip may be reached, otherwise the kind of rule
+// that refused it: "deny" or "private".
+func (p *destPolicy) decide(host string, ip netip.Addr) string {
+	for q := p; q != nil; q = q.parent {
+		switch q.verdict(host, ip) {
+		case aclDeny:
+			return "deny"
+		case aclAllow:
+			return ""
+		}
+	}
+	if ip.IsValid() && isNonPublicAddr(ip) && !p.privateAllowed() {
+		return "private"
+	}
+	return ""
+}
+
+func (p *destPolicy) privateAllowed() bool {
+	for q := p; q != nil; q = q.parent {
+		if q.allowPrivate != nil {
+			return *q.allowPrivate
+		}
+	}
+	return false
+}
+
+// nonPublicNets are ranges not covered by the netip predicates that still
+// lead into the host or its provider's network.
+var nonPublicNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, also some cloud metadata
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// isNonPublicAddr reports loopback, RFC 1918 / ULA, link-local (which
+// includes 169.254.169.254), multicast and reserved addresses.
+func isNonPublicAddr(ip netip.Addr) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	return matchNets(nonPublicNets, ip)
+}
+
+// aclDeniedError is returned for destinations the policy refuses.
+type aclDeniedError struct {
+	target string
+	rule   string // "deny", "private" or "reject" (a routing rule)
+}
+
+func (e *aclDeniedError) Error() string {
+	switch e.rule {
+	case "private":
+		return "destination " + e.target + " is not a public address"
+	case ruleReject:
+		return "destination " + e.target + " is rejected by the routing rules"
+	}
+	return "destination " + e.target + " is denied by the ACL"
+}
+
+// Check decides whether target (host:port) may be reached and returns the
+// address to use instead: for a domain, the resolved IP that passed the
+// check, so a second lookup cannot swap in a private one. Refusals are
+// *aclDeniedError; lookup failures are returned as they are. A nil policy
+// allows everything without resolving.
+func (p *destPolicy) Check(ctx context.Context, target string) (string, error) {
+	if p == nil {
+		return target, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if rule := p.decide("", ip.Unmap()); rule != "" {
+			return "", &aclDeniedError{target: target, rule: rule}
+		}
+		return target, nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if rule := p.decide(host, netip.Addr{}); rule == "deny" {
+		return "", &aclDeniedError{target: target, rule: rule}
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	rule := ""
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if rule = p.decide(host, ip); rule == "" {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return "", &aclDeniedError{target: target, rule: rule}
+}
+
+// CheckName is Check for destinations reached through an upstream, which
+// resolves the name itself: IP literals are checked in full, domains only
+// against domain rules.
+func (p *destPolicy) CheckName(target string) error {
+	if p == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err == nil {
+		host = ""
+		ip = ip.Unmap()
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	if rule := p.decide(host, ip); rule != "" {
+		return &aclDeniedError{target: target, rule: rule}
+	}
+	return nil
+}
+
+// countACLDenied records a refused destination.
+func countACLDenied(proto string, err *aclDeniedError) {
+	metricACLDenied.With(proto, err.rule).Inc()
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// socks5Credential is one RFC 1929 username/password pair.
+type socks5Credential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Match reports whether the given username/password pair matches c in constant time.
+func (c *socks5Credential) Match(username, password string) bool {
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(c.Username))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(c.Password))
+	return u&p == 1
+}
+
+// loadSOCKS5Credentials reads a JSON array of credentials, one entry per user port:
+//
+//	[{"username": "alice", "password": "..."}, {"username": "bob", "password": "..."}]
+//
+// Entry 0 guards user 1 (the starting port), entry 1 guards user 2, and so on.
+func loadSOCKS5Credentials(path string, n int) ([]*socks5Credential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds []*socks5Credential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(creds) < n {
+		return nil, fmt.Errorf("%s has %d credentials, need %d (one per user)", path, len(creds), n)
+	}
+	for i, c := range creds[:n] {
+		if c == nil || c.Username == "" || c.Password == "" {
+			return nil, fmt.Errorf("%s: entry %d needs a non-empty username and password", path, i)
+		}
+		// RFC 1929 encodes both fields with a one-byte length
+		if len(c.Username) > 255 || len(c.Password) > 255 {
+			return nil, fmt.Errorf("%s: entry %d username/password longer than 255 bytes", path, i)
+		}
+	}
+	return creds[:n], nil
+}
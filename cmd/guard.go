@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// banSweepInterval is how often expired bans and stale failure counts are
+// forgotten.
+const banSweepInterval = time.Minute
+
+func addGuardFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("client-allow", nil, "client CIDRs allowed to connect (default: anyone); per-port lists go under \"client_allow\" in --acl")
+	cmd.Flags().Int("ban-after", 5, "ban a client IP after this many failed handshakes within --ban-window (0 = never ban)")
+	cmd.Flags().Duration("ban-window", 10*time.Minute, "window in which failed handshakes are counted")
+	cmd.Flags().Duration("ban-time", time.Hour, "how long a banned client IP is refused")
+}
+
+// clientGuardFromFlags builds the source-IP checks of a command from its
+// flags and --acl file, and serves the ban list on the admin mux if any.
+func clientGuardFromFlags(cmd *cobra.Command, admin *http.ServeMux) (*clientGuard, error) {
+	allow, _ := cmd.Flags().GetStringSlice("client-allow")
+	after, _ := cmd.Flags().GetInt("ban-after")
+	window, _ := cmd.Flags().GetDuration("ban-window")
+	banFor, _ := cmd.Flags().GetDuration("ban-time")
+	if after < 0 || window <= 0 || banFor <= 0 {
+		return nil, fmt.Errorf("--ban-after must not be negative, --ban-window and --ban-time must be positive")
+	}
+	file, err := loadACLFile(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &clientGuard{
+		ports:   make(map[int][]netip.Prefix),
+		after:   after,
+		window:  window,
+		banFor:  banFor,
+		clients: make(map[netip.Addr]*clientFailures),
+	}
+	if g.allow, err = parseClientCIDRs(append(file.ClientAllow, allow...)); err != nil {
+		return nil, fmt.Errorf("client allowlist: %w", err)
+	}
+	for key, rules := range file.Ports {
+		port, _ := strconv.Atoi(key) // checked by loadACLFile
+		if rules.ClientAllow == nil {
+			continue
+		}
+		if g.ports[port], err = parseClientCIDRs(rules.ClientAllow); err != nil {
+			return nil, fmt.Errorf("port %d client allowlist: %w", port, err)
+		}
+	}
+
+	registerGaugeFunc("hidexx_banned_clients", "Client IPs currently banned for failed handshakes.",
+		func(emit func(float64, ...string)) { emit(float64(len(g.Bans()))) })
+	if admin != nil {
+		admin.HandleFunc("/bans", g.serveBans)
+	}
+	return g, nil
+}
+
+func parseClientCIDRs(entries []string) ([]netip.Prefix, error) {
+	nets := []netip.Prefix{} // non-nil: an empty per-port list admits nobody
+	for _, e := range entries {
+		if pfx, err := netip.ParsePrefix(e); err == nil {
+			nets = append(nets, pfx.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", e)
+		}
+		nets = append(nets, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+	}
+	return nets, nil
+}
+
+// clientGuard decides which client addresses may connect: an allowlist per
+// listening port (or a global one), and temporary bans for addresses that
+// keep failing handshakes. A nil *clientGuard admits everyone.
+type clientGuard struct {
+	allow []netip.Prefix         // empty = anyone
+	ports map[int][]netip.Prefix // overrides allow for one port
+
+	after  int
+	window time.Duration
+	banFor time.Duration
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*clientFailures
+}
+
+// clientFailures tracks one client address.
+type clientFailures struct {
+	count  int
+	since  time.Time // start of the current counting window
+	until  time.Time // banned until, zero if not banned
+	reason string    // last failure
+}
+
+// clientIP returns the address of a TCP or UDP peer.
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// Allowed reports whether remote is on the allowlist of port. It does not
+// look at bans, so it is safe for UDP, whose source addresses can be forged.
+func (g *clientGuard) Allowed(port int, remote net.Addr) bool {
+	if g == nil {
+		return true
+	}
+	nets, ok := g.ports[port]
+	if !ok {
+		nets = g.allow
+	}
+	if !ok && len(nets) == 0 {
+		return true
+	}
+	ip, valid := clientIP(remote)
+	if !valid {
+		return false
+	}
+	return matchNets(nets, ip)
+}
+
+// Admit reports whether a new TCP connection from remote on port may
+// proceed: the address must be allowed and not banned.
+func (g *clientGuard) Admit(port int, remote net.Addr) bool {
+	if g == nil {
+		return true
+	}
+	if !g.Allowed(port, remote) {
+		metricClientsRefused.With("not_allowed").Inc()
+		return false
+	}
+	ip, _ := clientIP(remote)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.clients[ip]; ok && time.Now().Before(c.until) {
+		metricClientsRefused.With("banned").Inc()
+		return false
+	}
+	return true
+}
+
+// HasAllowlist reports whether any client allowlist is configured.
+func (g *clientGuard) HasAllowlist() bool {
+	return g != nil && (len(g.allow) > 0 || len(g.ports) > 0)
+}
+
+// Fail records a failed handshake from remote and bans the address once it
+// has failed --ban-after times within --ban-window. Loopback addresses are
+// never banned: behind a SIP003 plugin or a local reverse proxy every client
+// arrives from there, and banning it would lock everyone out.
+func (g *clientGuard) Fail(remote net.Addr, reason string) {
+	if g == nil || g.after == 0 {
+		return
+	}
+	ip, ok := clientIP(remote)
+	if !ok || ip.IsLoopback() {
+		return
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.clients[ip]
+	if !ok || now.Sub(c.since) > g.window {
+		c = &clientFailures{since: now}
+		g.clients[ip] = c
+	}
+	c.count++
+	c.reason = reason
+	if c.count >= g.after && c.until.IsZero() {
+		c.until = now.Add(g.banFor)
+		slog.Warn("client banned", logRemote, ip.String(), "failures", c.count, "reason", reason, "for", g.banFor.String())
+	}
+}
+
+// sweepEvery sweeps every banSweepInterval until ctx is cancelled.
+func (g *clientGuard) sweepEvery(ctx context.Context) {
+	tick := time.NewTicker(banSweepInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			g.sweep()
+		}
+	}
+}
+
+// sweep forgets expired bans and failure counts whose window has passed.
+func (g *clientGuard) sweep() {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for ip, c := range g.clients {
+		if c.until.IsZero() && now.Sub(c.since) > g.window {
+			delete(g.clients, ip)
+		} else if !c.until.IsZero() && now.After(c.until) {
+			delete(g.clients, ip)
+			slog.Info("client ban expired", logRemote, ip.String())
+		}
+	}
+}
+
+// clientBan is one entry of the /bans admin endpoint.
+type clientBan struct {
+	IP       string    `json:"ip"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+	Reason   string    `json:"reason"`
+}
+
+// Bans lists the addresses currently banned, soonest expiry first.
+func (g *clientGuard) Bans() []clientBan {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := []clientBan{}
+	for ip, c := range g.clients {
+		if now.Before(c.until) {
+			out = append(out, clientBan{IP: ip.String(), Until: c.until, Failures: c.count, Reason: c.reason})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Until.Before(out[j].Until) })
+	return out
+}
+
+// Unban lifts a ban and resets the address's failure count.
+func (g *clientGuard) Unban(ip netip.Addr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.clients[ip]
+	delete(g.clients, ip)
+	return ok
+}
+
+// serveBans lists bans as JSON on GET; DELETE /bans?ip=ADDR lifts one.
+func (g *clientGuard) serveBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.Bans())
+	case http.MethodDelete:
+		ip, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+		if err != nil {
+			http.Error(w, "want ?ip=ADDRESS", http.StatusBadRequest)
+			return
+		}
+		if !g.Unban(ip.Unmap()) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Info("client unbanned", logRemote, ip.String())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
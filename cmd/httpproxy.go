@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// hopHeaders apply to a single connection and are not forwarded (RFC 9110
+// section 7.6.1), along with any header the Connection header names.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders strips hop-by-hop headers from h.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// handleHTTPProxy serves an HTTP proxy client whose request is read from br:
+// CONNECT tunnels, and plain http:// requests in absolute-URI form, which
+// are forwarded one at a time on a kept-alive connection. Users with a
+// password must send it as Proxy-Authorization basic auth.
+func handleHTTPProxy(conn net.Conn, br *bufio.Reader, u *proxyUser, guard *clientGuard) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		countHandshakeFailure("http", "request")
+		guard.Fail(conn.RemoteAddr(), "http request")
+		return
+	}
+	if !httpProxyAuthorized(conn, req, u, guard) {
+		return
+	}
+	if req.Method == http.MethodConnect {
+		httpProxyConnect(conn, br, req, u)
+		return
+	}
+	httpProxyForward(conn, br, req, u, guard)
+}
+
+// httpProxyAuthorized checks the request's credentials and answers 407 if
+// they are missing or wrong. Only wrong ones count as a failed handshake:
+// clients normally try without credentials first.
+func httpProxyAuthorized(conn net.Conn, req *http.Request, u *proxyUser, guard *clientGuard) bool {
+	if u.cred == nil {
+		return true
+	}
+	user, password, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth()
+	if ok && u.cred.Match(user, password) {
+		return true
+	}
+	if ok {
+		u.log.Warn("HTTP proxy auth failed", logRemote, conn.RemoteAddr().String())
+		countHandshakeFailure("http", "auth")
+		guard.Fail(conn.RemoteAddr(), "http auth")
+	}
+	writeHTTPProxyError(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"hidexx\"\r\n")
+	return false
+}
+
+// writeHTTPProxyError answers with an empty error response and ends the
+// connection. extra holds additional header lines, each ending in CRLF.
+func writeHTTPProxyError(conn net.Conn, code int, extra string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code), extra)
+}
+
+// httpProxyTarget returns host:port for a request authority, adding the
+// default port of the scheme.
+func httpProxyTarget(authority, defaultPort string) (string, error) {
+	if authority == "" {
+		return "", errors.New("missing host")
+	}
+	if _, _, err := net.SplitHostPort(authority); err == nil {
+		return authority, nil
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(authority, "["), "]")
+	return net.JoinHostPort(host, defaultPort), nil
+}
+
+// dialHTTPProxyTarget dials target for u, answering the client with 403 or
+// 502 if that fails.
+func dialHTTPProxyTarget(conn net.Conn, u *proxyUser, target string) (net.Conn, bool) {
+	remote, err := u.out.Dial(target)
+	var denied *aclDeniedError
+	if errors.As(err, &denied) {
+		u.log.Warn("destination denied", logRemote, conn.RemoteAddr().String(), logTarget, target, "rule", denied.rule)
+		countACLDenied("http", denied)
+		writeHTTPProxyError(conn, http.StatusForbidden, "")
+		return nil, false
+	}
+	if err != nil {
+		u.log.Warn("dial failed", logRemote, conn.RemoteAddr().String(), logTarget, target, "err", err)
+		countDialError(err)
+		writeHTTPProxyError(conn, http.StatusBadGateway, "")
+		return nil, false
+	}
+	return remote, true
+}
+
+// httpProxyConnect serves a CONNECT request with the same relay as SOCKS5.
+func httpProxyConnect(conn net.Conn, br *bufio.Reader, req *http.Request, u *proxyUser) {
+	target, err := httpProxyTarget(req.Host, "443")
+	if err != nil {
+		countHandshakeFailure("http", "request")
+		writeHTTPProxyError(conn, http.StatusBadRequest, "")
+		return
+	}
+	remote, ok := dialHTTPProxyTarget(conn, u, target)
+	if !ok {
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		remote.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Bytes the client sent after the request, such as a TLS ClientHello,
+	// may already be buffered.
+	client := conn
+	if n := br.Buffered(); n > 0 {
+		early, _ := br.Peek(n)
+		client = newPrefixConn(conn, early)
+	}
+	defer observeRelay("http", time.Now())
+	relayProxyConn(client, remote, u.traffic)
+}
+
+// trafficWriter counts bytes written to w against t in direction dir.
+type trafficWriter struct {
+	w   io.Writer
+	t   *userTraffic
+	dir int
+}
+
+func (w *trafficWriter) Write(b []byte) (int, error) {
+	w.t.Transfer(w.dir, len(b))
+	return w.w.Write(b)
+}
+
+// idleBody refreshes conn's read deadline before each read of a request body
+// that comes through a bufio.Reader on conn.
+type idleBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.conn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+	return b.ReadCloser.Read(p)
+}
+
+// readFinalResponse reads the origin's response to req, passing interim 1xx
+// responses such as 103 Early Hints on to w as they arrive.
+func readFinalResponse(br *bufio.Reader, req *http.Request, w io.Writer) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		removeHopHeaders(resp.Header)
+		if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+			return nil, err
+		}
+		if err := resp.Header.Write(w); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, "\r\n"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// httpProxyForward forwards absolute-URI http:// requests, starting with req,
+// until either side ends the connection. The connection to the origin is kept
+// while requests go to the same host. Both connections time out only after
+// relayIdleTimeout without progress, however long a transfer takes.
+func httpProxyForward(conn net.Conn, br *bufio.Reader, req *http.Request, u *proxyUser, guard *clientGuard) {
+	defer observeRelay("http", time.Now())
+
+	// Drop the handshake deadline; client reads and writes refresh their own.
+	conn.SetDeadline(time.Time{})
+	client := &idleConn{Conn: conn}
+
+	var remote net.Conn
+	var remoteBR *bufio.Reader
+	remoteTarget := ""
+	defer func() {
+		if remote != nil {
+			remote.Close()
+		}
+	}()
+
+	for {
+		if req.URL.Scheme != "http" {
+			countHandshakeFailure("http", "request")
+			writeHTTPProxyError(client, http.StatusBadRequest, "")
+			return
+		}
+		target, err := httpProxyTarget(req.URL.Host, "80")
+		if err != nil {
+			countHandshakeFailure("http", "request")
+			writeHTTPProxyError(client, http.StatusBadRequest, "")
+			return
+		}
+		if remote == nil || target != remoteTarget {
+			if remote != nil {
+				remote.Close()
+			}
+			dialed, ok := dialHTTPProxyTarget(client, u, target)
+			if !ok {
+				return
+			}
+			remote = &idleConn{Conn: dialed}
+			remoteBR, remoteTarget = bufio.NewReader(remote), target
+		}
+
+		keepAlive := !req.Close
+		removeHopHeaders(req.Header)
+		// Go would add its own User-Agent where the client sent none.
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = nil
+		}
+		// The body is written to the origin before its response is read,
+		// so the client is told to go ahead here rather than by the origin.
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			req.Header.Del("Expect")
+			if _, err := io.WriteString(client, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+				return
+			}
+		}
+		if req.Body != http.NoBody {
+			req.Body = &idleBody{ReadCloser: req.Body, conn: conn}
+		}
+		if err := req.Write(&trafficWriter{w: remote, t: u.traffic, dir: trafficUp}); err != nil {
+			u.log.Debug("HTTP forward failed", logRemote, conn.RemoteAddr().String(), logTarget, target, "err", err)
+			writeHTTPProxyError(client, http.StatusBadGateway, "")
+			return
+		}
+		resp, err := readFinalResponse(remoteBR, req, &trafficWriter{w: client, t: u.traffic, dir: trafficDown})
+		if err != nil {
+			u.log.Debug("HTTP forward failed", logRemote, conn.RemoteAddr().String(), logTarget, target, "err", err)
+			writeHTTPProxyError(client, http.StatusBadGateway, "")
+			return
+		}
+		// Once the origin closes, the client cannot be kept either: a body
+		// without a length ends where the connection does.
+		if resp.Close || resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+			keepAlive = false
+		}
+		removeHopHeaders(resp.Header)
+		resp.Close = !keepAlive
+		err = resp.Write(&trafficWriter{w: client, t: u.traffic, dir: trafficDown})
+		resp.Body.Close()
+		if err != nil || !keepAlive {
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+		if req, err = http.ReadRequest(br); err != nil {
+			return
+		}
+		if !httpProxyAuthorized(client, req, u, guard) {
+			return
+		}
+		if req.Method == http.MethodConnect {
+			remote.Close()
+			remote = nil
+			httpProxyConnect(conn, br, req, u)
+			return
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func addDrainFlag(cmd *cobra.Command) {
+	cmd.Flags().Duration("drain-timeout", 30*time.Second, "on SIGINT/SIGTERM, how long to let open connections finish before cutting them")
+}
+
+// lifecycle ties the listeners, connections and HTTP servers of a
+// long-running command to SIGINT/SIGTERM. On a signal it stops accepting,
+// lets open connections finish for up to drainTimeout, then cuts whatever is
+// left.
+type lifecycle struct {
+	ctx          context.Context
+	stop         context.CancelFunc
+	drainTimeout time.Duration
+
+	wg sync.WaitGroup // connection handlers
+
+	mu         sync.Mutex
+	stopping   bool        // set by Wait; no handler starts after it
+	closers    []io.Closer // listeners, stopped first
+	servers    []*http.Server
+	conns      map[net.Conn]struct{}
+	onShutdown []func()
+}
+
+func lifecycleFromFlags(cmd *cobra.Command) *lifecycle {
+	drain, _ := cmd.Flags().GetDuration("drain-timeout")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return &lifecycle{ctx: ctx, stop: stop, drainTimeout: drain, conns: make(map[net.Conn]struct{})}
+}
+
+// Context is cancelled when shutdown begins.
+func (lc *lifecycle) Context() context.Context {
+	return lc.ctx
+}
+
+// Stopping reports whether shutdown has begun. Accept loops check it to tell
+// a closed listener from a real error.
+func (lc *lifecycle) Stopping() bool {
+	return lc.ctx.Err() != nil
+}
+
+// AddCloser registers a listener or packet socket to be closed as soon as
+// shutdown begins.
+func (lc *lifecycle) AddCloser(c io.Closer) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.closers = append(lc.closers, c)
+}
+
+// RemoveCloser forgets a closer registered with AddCloser, for a listener
+// closed before shutdown.
+func (lc *lifecycle) RemoveCloser(c io.Closer) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for i, x := range lc.closers {
+		if x == c {
+			lc.closers = append(lc.closers[:i], lc.closers[i+1:]...)
+			return
+		}
+	}
+}
+
+// OnShutdown registers fn to run after connections have drained, e.g. to
+// persist counters.
+func (lc *lifecycle) OnShutdown(fn func()) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.onShutdown = append(lc.onShutdown, fn)
+}
+
+// Go runs handle for an accepted conn, tracking it so shutdown can wait for
+// it and, past the drain deadline, close it. Once shutdown has begun conn is
+// closed instead and handle never runs.
+func (lc *lifecycle) Go(conn net.Conn, handle func()) {
+	lc.mu.Lock()
+	if lc.stopping {
+		lc.mu.Unlock()
+		conn.Close()
+		return
+	}
+	lc.conns[conn] = struct{}{}
+	lc.wg.Add(1)
+	lc.mu.Unlock()
+
+	go func() {
+		defer lc.wg.Done()
+		defer func() {
+			lc.mu.Lock()
+			delete(lc.conns, conn)
+			lc.mu.Unlock()
+		}()
+		handle()
+	}()
+}
+
+// Run runs fn in the background; shutdown waits for it like a connection.
+// fn must return once Context is cancelled, and is dropped if shutdown has
+// already begun.
+func (lc *lifecycle) Run(fn func()) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.stopping {
+		return
+	}
+	lc.wg.Add(1)
+	go func() {
+		defer lc.wg.Done()
+		fn()
+	}()
+}
+
+// ListenAndServe binds srv.Addr now, so a busy port fails at startup, and
+// serves in the background until shutdown.
+func (lc *lifecycle) ListenAndServe(srv *http.Server) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	lc.mu.Lock()
+	lc.servers = append(lc.servers, srv)
+	lc.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTP server failed", "addr", srv.Addr, "err", err)
+		}
+	}()
+	return nil
+}
+
+// Wait blocks until a shutdown signal, drains, and returns the exit status:
+// 0 if everything finished within the drain timeout, 1 if connections or
+// requests had to be cut.
+func (lc *lifecycle) Wait() int {
+	<-lc.ctx.Done()
+	lc.stop() // a second signal now kills the process the default way
+	slog.Info("shutting down", "drain_timeout", lc.drainTimeout.String())
+
+	lc.mu.Lock()
+	lc.stopping = true // wg.Add happens under mu, so none can race wg.Wait below
+	closers, servers := lc.closers, lc.servers
+	lc.mu.Unlock()
+	for _, c := range closers {
+		c.Close()
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), lc.drainTimeout)
+	defer cancel()
+
+	var cut atomic.Bool
+	var swg sync.WaitGroup
+	for _, srv := range servers {
+		swg.Add(1)
+		go func(srv *http.Server) {
+			defer swg.Done()
+			if err := srv.Shutdown(deadline); err != nil {
+				slog.Warn("HTTP server did not drain in time", "addr", srv.Addr, "err", err)
+				srv.Close()
+				cut.Store(true)
+			}
+		}(srv)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		lc.wg.Wait()
+		swg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-deadline.Done():
+	}
+	select {
+	case <-drained: // also covers finishing right at the deadline
+	default:
+		lc.mu.Lock()
+		n := len(lc.conns)
+		for c := range lc.conns {
+			c.Close()
+		}
+		lc.mu.Unlock()
+		slog.Warn("drain timeout reached, closing remaining connections", "connections", n)
+		cut.Store(true)
+		<-drained
+	}
+
+	lc.mu.Lock()
+	hooks := lc.onShutdown
+	lc.mu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+	status := 0
+	if cut.Load() {
+		status = 1
+	}
+	slog.Info("shutdown complete", "status", status)
+	return status
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// limitLogInterval bounds how often repeated limit hits are logged per user,
+// so a scan cannot flood the log as well as the box.
+const limitLogInterval = 10 * time.Second
+
+func addLimitFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("max-conns", 256, "max concurrent connections per user (0 = unlimited)")
+	cmd.Flags().Int("max-conns-total", 2048, "max concurrent connections across all users (0 = unlimited)")
+	cmd.Flags().Int("accept-rate", 50, "max new connections per second per user (0 = unlimited)")
+}
+
+// connLimitsFromFlags builds the connection limits for a command from its flags.
+func connLimitsFromFlags(cmd *cobra.Command) (*connLimits, error) {
+	perUser, _ := cmd.Flags().GetInt("max-conns")
+	total, _ := cmd.Flags().GetInt("max-conns-total")
+	rate, _ := cmd.Flags().GetInt("accept-rate")
+	if perUser < 0 || total < 0 || rate < 0 {
+		return nil, fmt.Errorf("--max-conns, --max-conns-total and --accept-rate must not be negative")
+	}
+	l := &connLimits{perUser: int64(perUser), rate: int64(rate), users: make(map[string]*userConns)}
+	l.global = &userConns{limits: l, max: int64(total), log: slog.With(logListener, "shared")}
+	registerGaugeFunc("hidexx_active_connections", "Open client connections per user.", l.collect, "user")
+	return l, nil
+}
+
+// connLimits holds the concurrent-connection caps and accept rates of one
+// command. A nil *connLimits imposes nothing.
+type connLimits struct {
+	perUser int64
+	rate    int64
+	global  *userConns
+
+	mu    sync.Mutex
+	users map[string]*userConns
+}
+
+// User returns the limiter for the named user, creating it on first use.
+func (l *connLimits) User(name string) *userConns {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u, ok := l.users[name]
+	if !ok {
+		u = &userConns{limits: l, max: l.perUser, log: userLog(name)}
+		if l.rate > 0 {
+			u.accept = newTokenBucket(l.rate)
+		}
+		l.users[name] = u
+	}
+	return u
+}
+
+// Shared returns the limiter for a listener whose users are only known after
+// the handshake. It enforces only the global cap: once the user is known,
+// release it and acquire User(name) instead, which takes a global slot again.
+func (l *connLimits) Shared() *userConns {
+	if l == nil {
+		return nil
+	}
+	return l.global
+}
+
+// collect reports each user's open connections for /metrics. Connections on
+// a shared port that have not been identified yet are reported as user "".
+func (l *connLimits) collect(emit func(float64, ...string)) {
+	l.mu.Lock()
+	names := make([]string, 0, len(l.users))
+	for name := range l.users {
+		names = append(names, name)
+	}
+	l.mu.Unlock()
+	sort.Strings(names)
+
+	var identified int64
+	for _, name := range names {
+		n := l.User(name).Active()
+		identified += n
+		emit(float64(n), name)
+	}
+	if anon := l.global.Active() - identified; anon > 0 {
+		emit(float64(anon), "")
+	}
+}
+
+// userConns counts one user's open connections. A nil *userConns admits
+// everything.
+type userConns struct {
+	limits *connLimits
+	max    int64        // 0 = unlimited
+	accept *tokenBucket // nil = unlimited
+	log    *slog.Logger
+
+	active atomic.Int64
+
+	mu      sync.Mutex
+	logged  time.Time
+	dropped int
+}
+
+// Acquire admits one new connection from remote, or logs the limit it hit
+// and reports false. Every successful Acquire must be paired with Release.
+func (u *userConns) Acquire(remote string) bool {
+	if u == nil {
+		return true
+	}
+	if u.accept != nil && !u.accept.Allow(1) {
+		u.refuse(remote, "accept rate", int64(u.accept.rate))
+		return false
+	}
+	if n := u.active.Add(1); u.max > 0 && n > u.max {
+		u.active.Add(-1)
+		u.refuse(remote, "user connections", u.max)
+		return false
+	}
+	if g := u.limits.global; u != g {
+		if n := g.active.Add(1); g.max > 0 && n > g.max {
+			g.active.Add(-1)
+			u.active.Add(-1)
+			u.refuse(remote, "global connections", g.max)
+			return false
+		}
+	}
+	return true
+}
+
+// Release gives back a connection taken with Acquire.
+func (u *userConns) Release() {
+	if u == nil {
+		return
+	}
+	u.active.Add(-1)
+	if g := u.limits.global; u != g {
+		g.active.Add(-1)
+	}
+}
+
+// Active returns the number of connections currently held.
+func (u *userConns) Active() int64 {
+	if u == nil {
+		return 0
+	}
+	return u.active.Load()
+}
+
+// refuse logs a limit hit, summarising repeats within limitLogInterval.
+func (u *userConns) refuse(remote, limit string, value int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.dropped++
+	if time.Since(u.logged) < limitLogInterval {
+		return
+	}
+	u.log.Warn("connection limit hit", logRemote, remote, "limit", limit, "max", value, "refused", u.dropped)
+	u.logged, u.dropped = time.Now(), 0
+}
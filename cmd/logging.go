@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Log field names. Every log line about a client uses the same keys so the
+// JSON output can be filtered without per-message parsing.
+const (
+	logUser     = "user"     // user name from the registry
+	logListener = "listener" // "shared" for the single-port listener
+	logRemote   = "remote"   // client address
+	logTarget   = "target"   // host:port the client asked for
+	logBytes    = "bytes"
+)
+
+func init() {
+	rootCmd.PersistentFlags().String("log-level", "info", "log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-format", "text", "log format: text or json")
+}
+
+// setupLogging installs the default slog logger from the global flags. The
+// standard log package is routed through it as well, so library output ends
+// up in the same stream and format.
+func setupLogging(cmd *cobra.Command, args []string) error {
+	levelStr, _ := cmd.Flags().GetString("log-level")
+	format, _ := cmd.Flags().GetString("log-format")
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+		return fmt.Errorf("--log-level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("--log-format: want text or json, got %q", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs at error level and exits, for failures after startup output
+// has begun (a listener that cannot bind, say).
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// userLog returns the logger for one user's connections.
+func userLog(name string) *slog.Logger {
+	return slog.With(logUser, name)
+}
+
+// sensitiveKeys are attribute keys whose values never reach the log, even if
+// a call site forgets to wrap them in secret.
+var sensitiveKeys = map[string]bool{
+	"password": true, "passwd": true, "psk": true, "token": true, "key": true,
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redact(a.Value.String()))
+	}
+	return a
+}
+
+// secret is a string that logs in redacted form, e.g.
+// slog.Any("account", secret(pw)).
+type secret string
+
+func (s secret) LogValue() slog.Value {
+	return slog.StringValue(redact(string(s)))
+}
+
+// redact hides a secret, keeping only its length so a wrong-length key is
+// still visible when debugging.
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf("[redacted %d chars]", len(s))
+}
+
+// redactURL hides the parts of a URL that can carry credentials: userinfo,
+// query values and long path segments (subscription tokens are usually the
+// last segment).
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redact(raw)
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	q := u.Query()
+	for k := range q {
+		q.Set(k, "redacted")
+	}
+	u.RawQuery = q.Encode()
+	segs := strings.Split(u.Path, "/")
+	for i, s := range segs {
+		if len(s) >= 16 {
+			segs[i] = "redacted"
+		}
+	}
+	u.Path = strings.Join(segs, "/")
+	u.RawPath = ""
+	return u.String()
+}
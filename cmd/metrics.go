@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A minimal Prometheus registry. Only the text exposition format is
+// supported, which is all a scraper needs, and it keeps the binary free of
+// the client library's dependency tree.
+
+var (
+	metricBytes = newCounterVec("hidexx_bytes_total",
+		"Bytes relayed per user; direction is up (client to target) or down.", "user", "direction")
+	metricDialErrors = newCounterVec("hidexx_dial_errors_total",
+		"Outbound dials that failed, by reason.", "reason")
+	metricHandshakeFailures = newCounterVec("hidexx_handshake_failures_total",
+		"Client handshakes that failed, by protocol and reason.", "proto", "reason")
+	metricRelayDuration = newHistogramVec("hidexx_relay_duration_seconds",
+		"How long relayed TCP connections stayed open.",
+		[]float64{1, 5, 15, 60, 300, 900, 3600, 4 * 3600}, "proto")
+	metricACLDenied = newCounterVec("hidexx_acl_denied_total",
+		"Connections and UDP packets refused by the destination ACL, by protocol and rule.", "proto", "rule")
+	metricClientsRefused = newCounterVec("hidexx_refused_clients_total",
+		"Client connections refused before the handshake, by reason: banned or not_allowed.", "reason")
+	metricSubRequests = newCounterVec("hidexx_subscription_requests_total",
+		"Subscription downloads by user and client app.", "user", "client")
+)
+
+type metricWriter interface {
+	writeMetric(w io.Writer)
+}
+
+var metricRegistry struct {
+	mu   sync.Mutex
+	list []metricWriter
+}
+
+func registerMetric(m metricWriter) {
+	metricRegistry.mu.Lock()
+	defer metricRegistry.mu.Unlock()
+	metricRegistry.list = append(metricRegistry.list, m)
+}
+
+// metricsHandler serves every registered metric in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricRegistry.mu.Lock()
+	list := append([]metricWriter(nil), metricRegistry.list...)
+	metricRegistry.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range list {
+		m.writeMetric(w)
+	}
+}
+
+func addAdminFlag(cmd *cobra.Command) {
+	cmd.Flags().String("admin", "", "admin HTTP listen address serving /metrics, e.g. 127.0.0.1:9100 (empty = off)")
+}
+
+// startAdminFromFlags starts the admin HTTP server if --admin is set and
+// returns its mux, or nil when it is off.
+func startAdminFromFlags(cmd *cobra.Command, lc *lifecycle) *http.ServeMux {
+	addr, _ := cmd.Flags().GetString("admin")
+	if addr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	if err := lc.ListenAndServe(&http.Server{Addr: addr, Handler: mux}); err != nil {
+		fatal("admin HTTP server failed", "addr", addr, "err", err)
+	}
+	slog.Info("admin HTTP server listening", "addr", addr)
+	return mux
+}
+
+// metricKey joins label values into a map key.
+func metricKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a family.
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// metricLabels formats names and values as {a="x",b="y"}, with extra
+// appended as a pre-formatted pair (used for histogram "le").
+func metricLabels(names, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", n, strconv.Quote(values[i]))
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a family of monotonic counters keyed by label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counter
+}
+
+type counter struct {
+	values []string
+	n      atomic.Int64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	v := &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counter)}
+	registerMetric(v)
+	return v
+}
+
+// With returns the counter for the given label values, creating it at zero.
+func (v *counterVec) With(values ...string) *counter {
+	key := metricKey(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.series[key]
+	if !ok {
+		c = &counter{values: values}
+		v.series[key] = c
+	}
+	return c
+}
+
+// Add increases the counter by n. A nil *counter ignores it.
+func (c *counter) Add(n int64) {
+	if c != nil {
+		c.n.Add(n)
+	}
+}
+
+func (c *counter) Inc() { c.Add(1) }
+
+func (v *counterVec) writeMetric(w io.Writer) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*counter, len(keys))
+	for i, k := range keys {
+		series[i] = v.series[k]
+	}
+	v.mu.Unlock()
+
+	writeMetricHeader(w, v.name, v.help, "counter")
+	for _, c := range series {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, metricLabels(v.labels, c.values, ""), c.n.Load())
+	}
+}
+
+// gaugeFunc is a gauge family whose values are read at scrape time.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func(emit func(value float64, labelValues ...string))
+}
+
+// registerGaugeFunc adds a gauge whose collect callback emits one value per
+// label set on every scrape.
+func registerGaugeFunc(name, help string, collect func(emit func(value float64, labelValues ...string)), labels ...string) {
+	registerMetric(&gaugeFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+func (g *gaugeFunc) writeMetric(w io.Writer) {
+	writeMetricHeader(w, g.name, g.help, "gauge")
+	g.collect(func(value float64, values ...string) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, metricLabels(g.labels, values, ""), formatMetricValue(value))
+	})
+}
+
+// histogramVec is a family of histograms with shared bucket bounds.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending, without +Inf
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	values []string
+	counts []uint64 // per bucket, non-cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	v := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	registerMetric(v)
+	return v
+}
+
+// Observe records one value for the given label values.
+func (v *histogramVec) Observe(value float64, values ...string) {
+	key := metricKey(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{values: values, counts: make([]uint64, len(v.buckets)+1)}
+		v.series[key] = h
+	}
+	h.counts[sort.SearchFloat64s(v.buckets, value)]++
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) writeMetric(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeMetricHeader(w, v.name, v.help, "histogram")
+	for _, k := range keys {
+		h := v.series[k]
+		var cum uint64
+		for i, n := range h.counts {
+			cum += n
+			le := math.Inf(1)
+			if i < len(v.buckets) {
+				le = v.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name,
+				metricLabels(v.labels, h.values, "le="+strconv.Quote(formatMetricValue(le))), cum)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, metricLabels(v.labels, h.values, ""), formatMetricValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, metricLabels(v.labels, h.values, ""), h.count)
+	}
+}
+
+// observeRelay records how long a relay that started at start ran.
+func observeRelay(proto string, start time.Time) {
+	metricRelayDuration.Observe(time.Since(start).Seconds(), proto)
+}
+
+// countDialError records a failed outbound dial under a coarse reason.
+func countDialError(err error) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	reason := "other"
+	switch {
+	case errors.As(err, &dnsErr):
+		reason = "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		reason = "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		reason = "unreachable"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		reason = "timeout"
+	}
+	metricDialErrors.With(reason).Inc()
+}
+
+// countHandshakeFailure records a failed client handshake.
+func countHandshakeFailure(proto, reason string) {
+	metricHandshakeFailures.With(proto, reason).Inc()
+}
+
+// subscriptionClients are the app names recognised in subscription
+// User-Agents. Anything else is counted as "other" so a client cannot grow
+// the label set at will.
+var subscriptionClients = []string{
+	"clash", "mihomo", "stash", "shadowrocket", "quantumult", "surge",
+	"loon", "v2rayng", "sing-box", "curl", "wget", "mozilla",
+}
+
+// countSubscriptionRequest records one subscription download by a user.
+func countSubscriptionRequest(name, userAgent string) {
+	ua := strings.ToLower(userAgent)
+	client := "other"
+	for _, c := range subscriptionClients {
+		if strings.Contains(ua, c) {
+			client = c
+			break
+		}
+	}
+	metricSubRequests.With(name, client).Inc()
+}
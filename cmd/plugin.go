@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Plugin restart backoff. A plugin that stays up for pluginStableAfter is
+// considered healthy again and the backoff starts over.
+const (
+	pluginBackoffMin  = 1 * time.Second
+	pluginBackoffMax  = 30 * time.Second
+	pluginStableAfter = time.Minute
+)
+
+// pluginStopTimeout is how long a plugin gets to exit after SIGTERM on shutdown.
+const pluginStopTimeout = 5 * time.Second
+
+// sip003Plugin describes a SIP003 plugin run in front of each Shadowsocks port.
+type sip003Plugin struct {
+	Name       string // server-side binary, e.g. obfs-server or v2ray-plugin
+	Opts       string // SS_PLUGIN_OPTIONS for the server
+	ClientName string // plugin clients run, e.g. obfs-local
+	ClientOpts string // options clients pass to their plugin
+}
+
+// Options only the server side of a plugin understands.
+var pluginServerOnlyOpts = map[string]bool{
+	"server":    true,
+	"cert":      true,
+	"key":       true,
+	"failover":  true,
+	"fast-open": true,
+}
+
+// newSIP003Plugin resolves the plugin binary and works out what clients need.
+// clientOpts overrides the options derived from the server options.
+func newSIP003Plugin(name, opts, clientOpts string) (*sip003Plugin, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("plugin %q: %w", name, err)
+	}
+	p := &sip003Plugin{Name: name, Opts: opts, ClientName: name, ClientOpts: clientOpts}
+	if name == "obfs-server" {
+		p.ClientName = "obfs-local"
+	}
+	if clientOpts == "" {
+		var kept []string
+		for _, kv := range splitPluginOpts(opts) {
+			k, _, _ := strings.Cut(kv, "=")
+			if !pluginServerOnlyOpts[k] {
+				kept = append(kept, kv)
+			}
+		}
+		p.ClientOpts = strings.Join(kept, ";")
+	}
+	return p, nil
+}
+
+// splitPluginOpts splits "a=1;b;c=x\;y" on unescaped semicolons.
+func splitPluginOpts(opts string) []string {
+	var parts []string
+	var cur strings.Builder
+	for i := 0; i < len(opts); i++ {
+		switch {
+		case opts[i] == '\\' && i+1 < len(opts):
+			i++
+			cur.WriteByte(opts[i])
+		case opts[i] == ';':
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(opts[i])
+		}
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	return parts
+}
+
+// run starts the plugin listening on the public port and forwarding to the
+// local Shadowsocks listener, restarting it whenever it exits. When ctx is
+// cancelled the plugin gets SIGTERM, then SIGKILL if it lingers.
+func (p *sip003Plugin) run(ctx context.Context, publicPort, localPort int, lg *slog.Logger) {
+	backoff := pluginBackoffMin
+	for {
+		cmd := exec.CommandContext(ctx, p.Name)
+		cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+		cmd.WaitDelay = pluginStopTimeout
+		cmd.Env = append(os.Environ(),
+			"SS_REMOTE_HOST=0.0.0.0",
+			"SS_REMOTE_PORT="+strconv.Itoa(publicPort),
+			"SS_LOCAL_HOST=127.0.0.1",
+			"SS_LOCAL_PORT="+strconv.Itoa(localPort),
+			"SS_PLUGIN_OPTIONS="+p.Opts,
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			lg.Error("plugin start failed", "plugin", p.Name, "err", err)
+		} else {
+			lg.Info("plugin started", "plugin", p.Name, "pid", cmd.Process.Pid, "port", publicPort, "local_port", localPort)
+			err = cmd.Wait()
+			if ctx.Err() != nil {
+				lg.Info("plugin stopped", "plugin", p.Name)
+				return
+			}
+			lg.Warn("plugin exited", "plugin", p.Name, "err", err)
+		}
+
+		if time.Since(started) > pluginStableAfter {
+			backoff = pluginBackoffMin
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > pluginBackoffMax {
+			backoff = pluginBackoffMax
+		}
+	}
+}
+
+// URLParam is the SIP002 "plugin" query value, e.g. "obfs-local;obfs=http".
+func (p *sip003Plugin) URLParam() string {
+	if p.ClientOpts == "" {
+		return p.ClientName
+	}
+	return p.ClientName + ";" + p.ClientOpts
+}
+
+// ClashYAML returns the plugin/plugin-opts lines of a Clash proxy entry,
+// indented to sit under "  - name: ...".
+func (p *sip003Plugin) ClashYAML() string {
+	name := p.ClientName
+	opts := map[string]string{}
+	var flags []string
+	for _, kv := range splitPluginOpts(p.ClientOpts) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			flags = append(flags, k)
+			continue
+		}
+		opts[k] = v
+	}
+
+	var b strings.Builder
+	switch name {
+	case "obfs-local":
+		fmt.Fprintf(&b, "    plugin: obfs\n    plugin-opts:\n")
+		fmt.Fprintf(&b, "      mode: %s\n", opts["obfs"])
+		if h := opts["obfs-host"]; h != "" {
+			fmt.Fprintf(&b, "      host: %s\n", h)
+		}
+	case "v2ray-plugin":
+		mode := opts["mode"]
+		if mode == "" {
+			mode = "websocket"
+		}
+		fmt.Fprintf(&b, "    plugin: v2ray-plugin\n    plugin-opts:\n")
+		fmt.Fprintf(&b, "      mode: %s\n", mode)
+		for _, f := range flags {
+			if f == "tls" {
+				fmt.Fprintf(&b, "      tls: true\n")
+			}
+		}
+		if h := opts["host"]; h != "" {
+			fmt.Fprintf(&b, "      host: %s\n", h)
+		}
+		if path := opts["path"]; path != "" {
+			fmt.Fprintf(&b, "      path: %q\n", path)
+		}
+	default:
+		// Clash has no generic SIP003 support; pass the options through as-is
+		fmt.Fprintf(&b, "    plugin: %s\n", name)
+		if len(opts) > 0 || len(flags) > 0 {
+			fmt.Fprintf(&b, "    plugin-opts:\n")
+			for _, kv := range splitPluginOpts(p.ClientOpts) {
+				k, v, ok := strings.Cut(kv, "=")
+				if !ok {
+					v = "true"
+				}
+				fmt.Fprintf(&b, "      %s: %q\n", k, v)
+			}
+		}
+	}
+	return b.String()
+}
+
+// listenSS opens the TCP listener for a Shadowsocks port. With a plugin the
+// server listens on a loopback port and the plugin takes the public one.
+// Closing the listener stops the plugin; both happen when lc shuts down.
+func listenSS(lc *lifecycle, port int, plugin *sip003Plugin, lg *slog.Logger) (net.Listener, error) {
+	if plugin == nil {
+		ln, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(port))
+		if err == nil {
+			lc.AddCloser(ln)
+		}
+		return ln, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(lc.Context())
+	pl := &pluginListener{Listener: ln, stop: cancel}
+	lc.AddCloser(pl)
+	lc.Run(func() { plugin.run(ctx, port, ln.Addr().(*net.TCPAddr).Port, lg) })
+	return pl, nil
+}
+
+// pluginListener stops the plugin in front of it when closed.
+type pluginListener struct {
+	net.Listener
+	stop context.CancelFunc
+}
+
+func (l *pluginListener) Close() error {
+	l.stop()
+	return l.Listener.Close()
+}
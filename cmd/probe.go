@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// What to do with a connection that fails the Shadowsocks handshake.
+const (
+	failClose    = "close"    // close immediately (easy to fingerprint)
+	failDrain    = "drain"    // keep reading and discard until a random timeout
+	failFallback = "fallback" // replay the bytes to a decoy service and relay
+)
+
+// Drain hold time bounds. Real servers rarely close on garbage within a fixed
+// interval, so the hold is randomised per connection.
+const (
+	failDrainMin = 15 * time.Second
+	failDrainMax = 75 * time.Second
+)
+
+// maxFailDrains caps how many failed handshakes are drained at once. Drains
+// hold no connection slot, so past this they are closed at once instead of
+// piling up under a scan.
+const maxFailDrains = 512
+
+// maxRecordedHandshake caps how much of a failed handshake is kept for fallback.
+const maxRecordedHandshake = 64 * 1024
+
+// failPolicy decides how handshake failures look to the peer.
+type failPolicy struct {
+	mode     string
+	fallback string        // host:port, for failFallback
+	drains   chan struct{} // one token per drain in progress, for failDrain
+}
+
+func newFailPolicy(mode, fallback string) (*failPolicy, error) {
+	switch mode {
+	case failClose:
+		return &failPolicy{mode: mode}, nil
+	case failDrain:
+		return &failPolicy{mode: mode, drains: make(chan struct{}, maxFailDrains)}, nil
+	case failFallback:
+		if _, _, err := net.SplitHostPort(fallback); err != nil {
+			return nil, fmt.Errorf("fallback mode needs --fallback host:port: %w", err)
+		}
+		return &failPolicy{mode: mode, fallback: fallback}, nil
+	}
+	return nil, fmt.Errorf("unknown failure mode %q (want %s, %s or %s)", mode, failClose, failDrain, failFallback)
+}
+
+// apply handles a connection whose handshake failed. The caller still closes
+// it. release gives back the connection's limiter slot; it is called before
+// a drain, so garbage being discarded does not count against real clients,
+// and must be safe to call again.
+func (p *failPolicy) apply(rc *recordConn, lg *slog.Logger, release func()) {
+	switch p.mode {
+	case failDrain:
+		release()
+		select {
+		case p.drains <- struct{}{}:
+			defer func() { <-p.drains }()
+		default:
+			lg.Debug("too many drains, closing", logRemote, rc.RemoteAddr().String())
+			return
+		}
+		hold := failDrainMin + time.Duration(rand.Int63n(int64(failDrainMax-failDrainMin)))
+		rc.Conn.SetReadDeadline(time.Now().Add(hold))
+		io.Copy(io.Discard, rc.Conn)
+	case failFallback:
+		remote, err := net.DialTimeout("tcp", p.fallback, 10*time.Second)
+		if err != nil {
+			lg.Warn("fallback dial failed", logTarget, p.fallback, "err", err)
+			return
+		}
+		if _, err := remote.Write(rc.Recorded()); err != nil {
+			remote.Close()
+			return
+		}
+		rc.Conn.SetReadDeadline(time.Time{})
+		bidirectionalRelay(rc.Conn, remote, nil)
+	}
+}
+
+// recordConn keeps a copy of everything read until Stop, so a failed
+// handshake can be replayed to the fallback service.
+type recordConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	buf     []byte
+	stopped bool
+}
+
+func newRecordConn(c net.Conn) *recordConn {
+	return &recordConn{Conn: c}
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.stopped && len(c.buf)+n <= maxRecordedHandshake {
+			c.buf = append(c.buf, b[:n]...)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// Stop ends recording and releases the buffer once the handshake succeeded.
+func (c *recordConn) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	c.buf = nil
+}
+
+func (c *recordConn) Recorded() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf
+}
+
+// stopRecording ends recording on conn, looking through a prefixConn if needed.
+func stopRecording(conn net.Conn) {
+	switch c := conn.(type) {
+	case *recordConn:
+		c.Stop()
+	case *prefixConn:
+		stopRecording(c.Conn)
+	}
+}
@@ -1,24 +1,48 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"os"
 	"strconv"
 	"time"
 
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"github.com/spf13/cobra"
 )
 
 var proxyCmd = &cobra.Command{
 	Use:   "proxy",
-	Short: "Run SOCKS5 proxy server (one port per user)",
-	Run:   runProxy,
+	Short: "Run SOCKS5 and HTTP proxy server (one port per user)",
+	Long: `Run SOCKS5 and HTTP proxy server (one port per user).
+
+Users and their ports come from ` + usersFile + ` in the state directory, the
+same registry ss uses, so ss and proxy on one host need separate --state-dir
+directories. Users without a password get a generated one, as with ss,
+unless --no-auth is given.`,
+	Run: runProxy,
 }
 
 func init() {
-	proxyCmd.Flags().IntP("users", "n", 2, "number of proxy ports")
-	proxyCmd.Flags().IntP("port", "p", 51801, "starting port (user1=port, user2=port+1, ...)")
+	proxyCmd.Flags().IntP("users", "n", 2, "number of users to create if "+usersFile+" does not exist yet")
+	proxyCmd.Flags().IntP("port", "p", 51801, "port given to users without one (user1=port, user2=port+1, ...)")
+	proxyCmd.Flags().Bool("mixed", true, "also accept HTTP proxy clients (CONNECT and http:// URLs) on each port, told apart from SOCKS5 by the first byte")
+	proxyCmd.Flags().String("auth-file", "", "JSON file with one {username, password} per user port (RFC 1929), imported when "+usersFile+" is created")
+	proxyCmd.Flags().Bool("no-auth", false, "serve users without a password open to anyone instead of generating one")
+
+	addTrafficFlags(proxyCmd)
+	addLimitFlags(proxyCmd)
+	addACLFlags(proxyCmd)
+	addGuardFlags(proxyCmd)
+	addUpstreamFlags(proxyCmd)
+	addRuleFlags(proxyCmd)
+	addAdminFlag(proxyCmd)
+	addDrainFlag(proxyCmd)
 
 	rootCmd.AddCommand(proxyCmd)
 }
@@ -26,63 +50,252 @@ func init() {
 func runProxy(cmd *cobra.Command, args []string) {
 	numUsers, _ := cmd.Flags().GetInt("users")
 	basePort, _ := cmd.Flags().GetInt("port")
+	authFile, _ := cmd.Flags().GetString("auth-file")
+	noAuth, _ := cmd.Flags().GetBool("no-auth")
+	mixed, _ := cmd.Flags().GetBool("mixed")
+
+	if err := checkStateDir(); err != nil {
+		fatal("unusable state directory", "path", stateDir, "err", err)
+	}
 
-	fmt.Println("=== hidexx SOCKS5 proxy server ===")
+	var legacy []*userEntry
+	if authFile != "" {
+		if _, err := os.Stat(statePath(usersFile)); err == nil {
+			fatal("--auth-file is only imported when the user registry is created; manage users with \"hidexx user\" instead", "path", statePath(usersFile), "auth_file", authFile)
+		}
+		creds, err := loadSOCKS5Credentials(authFile, numUsers)
+		if err != nil {
+			fatal("cannot load auth file", "path", authFile, "err", err)
+		}
+		for i, c := range creds {
+			legacy = append(legacy, &userEntry{Name: c.Username, Port: basePort + i, Password: c.Password})
+		}
+	}
+	unlock, err := lockUsers()
+	if err != nil {
+		fatal("cannot lock users", "path", statePath(usersFile), "err", err)
+	}
+	users, err := loadOrCreateUsers(numUsers, basePort, legacy)
+	if err != nil {
+		fatal("cannot load users", "path", statePath(usersFile), "err", err)
+	}
+	changed := users.assignPorts(basePort)
+	if !noAuth {
+		m, _ := lookupSSMethod(defaultSSMethod)
+		if users.fillPasswords(m) {
+			changed = true
+		}
+	}
+	if changed {
+		if err := users.Save(); err != nil {
+			fatal("cannot save users", "path", statePath(usersFile), "err", err)
+		}
+	}
+	unlock()
+
+	traffic, err := trafficStoreFromFlags(cmd, "proxy")
+	if err != nil {
+		fatal("cannot set up traffic accounting", "err", err)
+	}
+	limits, err := connLimitsFromFlags(cmd)
+	if err != nil {
+		fatal("invalid connection limits", "err", err)
+	}
+	acl, err := destACLFromFlags(cmd)
+	if err != nil {
+		fatal("invalid destination ACL", "err", err)
+	}
+	upstreams, err := upstreamSetFromFlags(cmd)
+	if err != nil {
+		fatal("invalid upstreams", "err", err)
+	}
+	for _, e := range users.Enabled() {
+		if err := upstreams.Check(e.Upstream); err != nil {
+			fatal("invalid user upstream", logUser, e.Name, "upstream", e.Upstream, "err", err)
+		}
+	}
+	lc := lifecycleFromFlags(cmd)
+	lc.OnShutdown(func() { saveTraffic(traffic) })
+	lc.Run(func() { traffic.saveEvery(lc.Context()) })
+	go upstreams.WatchRules(lc)
+	guard, err := clientGuardFromFlags(cmd, startAdminFromFlags(cmd, lc))
+	if err != nil {
+		fatal("invalid client guard settings", "err", err)
+	}
+	lc.Run(func() { guard.sweepEvery(lc.Context()) })
+
+	if mixed {
+		fmt.Println("=== hidexx SOCKS5/HTTP proxy server ===")
+	} else {
+		fmt.Println("=== hidexx SOCKS5 proxy server ===")
+	}
 	fmt.Println()
 
 	ip := getPublicIP()
 
-	for i := 0; i < numUsers; i++ {
-		port := basePort + i
-		userID := i + 1
-		go startSOCKS5(port, userID)
-		fmt.Printf("  user %d: %s:%d\n", userID, ip, port)
+	anyOpen := false
+	for _, e := range users.Enabled() {
+		u := &proxyUser{name: e.Name, traffic: traffic.User(e.Name), conns: limits.User(e.Name), log: userLog(e.Name)}
+		if e.Password != "" {
+			u.cred = &socks5Credential{Username: e.Name, Password: e.Password}
+		}
+		u.traffic.SetQuota(e.QuotaBytes(traffic.quota))
+		u.out, _ = newEgress(acl.Port(e.Port), upstreams, e.Upstream) // checked above
+		go startSOCKS5(lc, e.Port, u, guard, mixed)
+		if u.cred != nil {
+			fmt.Printf("  user %s: %s:%d (username: %s, password: %s)\n", e.Name, ip, e.Port, e.Name, e.Password)
+		} else {
+			fmt.Printf("  user %s: %s:%d\n", e.Name, ip, e.Port)
+			anyOpen = true
+		}
 	}
 
 	fmt.Println()
+	if anyOpen {
+		fmt.Println("WARNING: users without a password in " + statePath(usersFile) + " have ports open to anyone")
+	}
 	fmt.Println("proxy server running...")
 
-	select {}
+	os.Exit(lc.Wait())
+}
+
+// proxyHandshakeTimeout bounds the SOCKS5 negotiation or the HTTP request
+// line and headers.
+const proxyHandshakeTimeout = 10 * time.Second
+
+// proxyUser is one user port of the proxy and the state shared by its
+// connections.
+type proxyUser struct {
+	name    string
+	cred    *socks5Credential // nil = no auth
+	traffic *userTraffic
+	conns   *userConns
+	out     *egress
+	log     *slog.Logger
 }
 
-const socks5HandshakeTimeout = 10 * time.Second
+// SOCKS5 method and status bytes (RFC 1928 section 3, RFC 1929 section 2).
+const (
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5UserPassVersion = 0x01
+	socks5UserPassOK      = 0x00
+	socks5UserPassFailure = 0x01
+
+	socks5ReplyNotAllowed = 0x02 // connection not allowed by ruleset
+)
 
-func startSOCKS5(port, userID int) {
+// startSOCKS5 serves u on port: SOCKS5, and with mixed also HTTP proxy
+// requests.
+func startSOCKS5(lc *lifecycle, port int, u *proxyUser, guard *clientGuard, mixed bool) {
 	addr := "0.0.0.0:" + strconv.Itoa(port)
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("[user %d] listen %s: %v", userID, addr, err)
+		fatal("listen failed", logUser, u.name, "addr", addr, "err", explainPortInUse(err))
 	}
-	log.Printf("[user %d] SOCKS5 listening on %s", userID, addr)
+	lc.AddCloser(ln)
+	lg := u.log
+	lg.Info("SOCKS5 listening", "addr", addr, "auth", u.cred != nil, "http", mixed)
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("[user %d] accept: %v", userID, err)
+			if lc.Stopping() {
+				return
+			}
+			lg.Warn("accept failed", "err", err)
 			continue
 		}
-		go handleSOCKS5(conn)
+		if !guard.Admit(port, conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		if u.traffic.OverQuota() || !u.conns.Acquire(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		lc.Go(conn, func() {
+			defer u.conns.Release()
+			handleProxyConn(conn, u, guard, mixed)
+		})
 	}
 }
 
-func handleSOCKS5(conn net.Conn) {
+// handleProxyConn tells SOCKS5 clients, whose first byte is the version 5,
+// from HTTP proxy clients (with mixed) and serves the connection.
+func handleProxyConn(conn net.Conn, u *proxyUser, guard *clientGuard, mixed bool) {
 	defer conn.Close()
 
-	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
 
+	first := make([]byte, 1)
+	_, err := io.ReadFull(conn, first)
+	switch {
+	case err == nil && first[0] == 0x05:
+		serveSOCKS5(conn, u, guard)
+	case err == nil && mixed:
+		handleHTTPProxy(conn, bufio.NewReader(newPrefixConn(conn, first)), u, guard)
+	default:
+		countHandshakeFailure("socks5", "greeting")
+		guard.Fail(conn.RemoteAddr(), "socks5 greeting")
+	}
+}
+
+// serveSOCKS5 runs the SOCKS5 negotiation after the version byte and serves
+// the request.
+func serveSOCKS5(conn net.Conn, u *proxyUser, guard *clientGuard) {
 	buf := make([]byte, 256)
 
-	// 1. greeting
-	n, err := conn.Read(buf)
-	if err != nil || n < 2 || buf[0] != 0x05 {
+	// 1. greeting: VER NMETHODS METHODS... (VER already read)
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil || buf[0] == 0 {
+		countHandshakeFailure("socks5", "greeting")
+		guard.Fail(conn.RemoteAddr(), "socks5 greeting")
+		return
+	}
+	methods := buf[:buf[0]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		countHandshakeFailure("socks5", "greeting")
+		guard.Fail(conn.RemoteAddr(), "socks5 greeting")
+		return
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if u.cred != nil {
+		want = socks5MethodUserPass
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		conn.Write([]byte{0x05, socks5MethodNoAcceptable})
+		countHandshakeFailure("socks5", "method")
+		guard.Fail(conn.RemoteAddr(), "socks5 method")
+		return
+	}
+	conn.Write([]byte{0x05, want})
+
+	// 1b. username/password sub-negotiation
+	if u.cred != nil && !socks5Authenticate(conn, u.cred) {
+		u.log.Warn("SOCKS5 auth failed", logRemote, conn.RemoteAddr().String())
+		countHandshakeFailure("socks5", "auth")
+		guard.Fail(conn.RemoteAddr(), "socks5 auth")
 		return
 	}
-	conn.Write([]byte{0x05, 0x00})
 
 	// 2. request
-	n, err = conn.Read(buf)
-	if err != nil || n < 7 || buf[0] != 0x05 || buf[1] != 0x01 {
+	n, err := conn.Read(buf)
+	if err != nil || n < 7 || buf[0] != 0x05 || (buf[1] != socks.CmdConnect && buf[1] != socks.CmdUDPAssociate) {
 		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		countHandshakeFailure("socks5", "request")
+		return
+	}
+
+	if buf[1] == socks.CmdUDPAssociate {
+		hint := socks.SplitAddr(buf[3:n])
+		if hint == nil {
+			conn.Write([]byte{0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		handleSOCKS5UDP(conn, u.name, hint, u.traffic, u.out)
 		return
 	}
 
@@ -115,8 +328,17 @@ func handleSOCKS5(conn net.Conn) {
 	}
 
 	// connect to target
-	remote, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+	remote, err := u.out.Dial(targetAddr)
+	var denied *aclDeniedError
+	if errors.As(err, &denied) {
+		u.log.Warn("destination denied", logRemote, conn.RemoteAddr().String(), logTarget, targetAddr, "rule", denied.rule)
+		countACLDenied("socks5", denied)
+		conn.Write([]byte{0x05, socks5ReplyNotAllowed, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
 	if err != nil {
+		u.log.Warn("dial failed", logRemote, conn.RemoteAddr().String(), logTarget, targetAddr, "err", err)
+		countDialError(err)
 		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 		return
 	}
@@ -125,6 +347,49 @@ func handleSOCKS5(conn net.Conn) {
 	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
 	conn.SetDeadline(time.Time{})
 
-	// relay with idle timeout, both directions auto-close
-	bidirectionalRelay(conn, remote)
+	defer observeRelay("socks5", time.Now())
+	relayProxyConn(conn, remote, u.traffic)
+}
+
+// relayProxyConn relays between a client connection and remote with idle
+// timeout, splicing when both are plain TCP and no rate limit applies.
+func relayProxyConn(conn, remote net.Conn, t *userTraffic) {
+	if tc, ok := conn.(*net.TCPConn); ok && !t.Limited() {
+		if rc, ok := remote.(*net.TCPConn); ok {
+			bidirectionalSplice(tc, rc, t)
+			return
+		}
+	}
+	bidirectionalRelay(conn, remote, t)
+}
+
+// socks5Authenticate runs the RFC 1929 sub-negotiation and writes the status reply.
+func socks5Authenticate(conn net.Conn, cred *socks5Credential) bool {
+	buf := make([]byte, 255)
+
+	// VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != socks5UserPassVersion {
+		conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return false
+	}
+	uname := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return false
+	}
+	username := string(uname)
+
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return false
+	}
+	passwd := buf[:buf[0]]
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return false
+	}
+
+	if !cred.Match(username, string(passwd)) {
+		conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return false
+	}
+	conn.Write([]byte{socks5UserPassVersion, socks5UserPassOK})
+	return true
 }
@@ -1,20 +1,87 @@
 package cmd
 
 import (
+	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
 const relayIdleTimeout = 60 * time.Second
 
-// bidirectionalRelay copies data between two connections with idle timeout.
-// When either direction fails or times out, both connections are closed.
-func bidirectionalRelay(a, b net.Conn) {
+var errRelayIdle = errors.New("relay idle timeout")
+
+// relayDirection is one half of a relay: copy moves bytes until the source
+// ends (nil on a clean EOF), closeWrite forwards that EOF to the destination.
+type relayDirection struct {
+	copy       func() error
+	closeWrite func() bool
+}
+
+// runRelay runs both directions. A direction that ends with EOF half-closes its
+// destination and leaves the other direction running until it finishes or
+// idles out; an error, or a destination that cannot be half-closed, tears
+// down both sides. closeAll always runs once both directions are done.
+func runRelay(closeAll func(), up, down relayDirection) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	for _, d := range []relayDirection{up, down} {
+		go func(d relayDirection) {
+			defer wg.Done()
+			if err := d.copy(); err != nil || !d.closeWrite() {
+				closeAll()
+			}
+		}(d)
+	}
+
+	wg.Wait()
+	closeAll()
+}
+
+// idleConn refreshes the deadline of the wrapped connection before every Read
+// and Write, so it times out only after relayIdleTimeout without progress.
+// It is for request/response exchanges that cannot use the relay loops.
+type idleConn struct {
+	net.Conn
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(relayIdleTimeout))
+	return c.Conn.Write(b)
+}
+
+// closeWrite sends FIN on c if the underlying connection supports it,
+// looking through the wrappers used on the Shadowsocks accept path.
+func closeWrite(c net.Conn) bool {
+	for {
+		switch v := c.(type) {
+		case interface{ CloseWrite() error }:
+			return v.CloseWrite() == nil
+		case *prefixConn:
+			c = v.Conn
+		case *recordConn:
+			c = v.Conn
+		case *idleConn:
+			c = v.Conn
+		default:
+			return false
+		}
+	}
+}
+
+// bidirectionalRelay copies data between a client connection a and a remote
+// connection b with idle timeout, counting bytes against t (may be nil).
+// EOF in one direction is forwarded as a half-close; errors and timeouts
+// close both connections.
+func bidirectionalRelay(a, b net.Conn, t *userTraffic) {
 	closeOnce := sync.Once{}
 	closeAll := func() {
 		closeOnce.Do(func() {
@@ -23,43 +90,97 @@ func bidirectionalRelay(a, b net.Conn) {
 		})
 	}
 
-	go func() {
-		defer wg.Done()
-		relayWithTimeout(a, b)
-		closeAll()
-	}()
-	go func() {
-		defer wg.Done()
-		relayWithTimeout(b, a)
-		closeAll()
-	}()
-
-	wg.Wait()
+	runRelay(closeAll,
+		relayDirection{
+			copy:       func() error { return relayWithTimeout(a, b, t, trafficDown) },
+			closeWrite: func() bool { return closeWrite(a) },
+		},
+		relayDirection{
+			copy:       func() error { return relayWithTimeout(b, a, t, trafficUp) },
+			closeWrite: func() bool { return closeWrite(b) },
+		},
+	)
 }
 
 // relayWithTimeout copies from src to dst, resetting a deadline on each successful read.
-func relayWithTimeout(dst, src net.Conn) {
+// Bytes are counted against t in direction dir. It returns nil when src reaches EOF.
+func relayWithTimeout(dst, src net.Conn, t *userTraffic, dir int) error {
 	buf := make([]byte, 32*1024)
 	for {
 		src.SetReadDeadline(time.Now().Add(relayIdleTimeout))
 		n, err := src.Read(buf)
 		if n > 0 {
+			t.Transfer(dir, n)
 			dst.SetWriteDeadline(time.Now().Add(relayIdleTimeout))
 			if _, wErr := dst.Write(buf[:n]); wErr != nil {
-				return
+				return wErr
 			}
 		}
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return
+			return err
 		}
 	}
 }
 
-// relayConn is a helper for relaying between a net.Conn and an io.ReadWriter (e.g. cipher stream).
-func bidirectionalRelayRW(conn net.Conn, rw io.ReadWriter, remoteConn net.Conn) {
-	var wg sync.WaitGroup
-	wg.Add(2)
+// spliceCheckInterval is how often a splice relay wakes up to check for idleness.
+// io.Copy hides individual reads, so idle time is measured in these steps.
+const spliceCheckInterval = relayIdleTimeout / 4
 
+// bidirectionalSplice is bidirectionalRelay for two plain TCP connections.
+// It uses io.Copy so Linux can splice between the sockets without copying
+// through user space. Idle timeout is enforced to within spliceCheckInterval,
+// and bytes are counted against t at the same granularity. It cannot apply a
+// rate limit; use bidirectionalRelay when t.Limited().
+func bidirectionalSplice(a, b *net.TCPConn, t *userTraffic) {
+	closeOnce := sync.Once{}
+	closeAll := func() {
+		closeOnce.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+
+	runRelay(closeAll,
+		relayDirection{
+			copy:       func() error { return spliceWithTimeout(a, b, t, trafficDown) },
+			closeWrite: func() bool { return a.CloseWrite() == nil },
+		},
+		relayDirection{
+			copy:       func() error { return spliceWithTimeout(b, a, t, trafficUp) },
+			closeWrite: func() bool { return b.CloseWrite() == nil },
+		},
+	)
+}
+
+// spliceWithTimeout copies from src to dst with io.Copy, waking every
+// spliceCheckInterval to see whether anything moved. Only a read deadline is
+// used: a write timeout in the middle of a splice would drop buffered bytes.
+// A stuck writer is released when the other direction idles out and closes both.
+func spliceWithTimeout(dst, src *net.TCPConn, t *userTraffic, dir int) error {
+	lastActive := time.Now()
+	for {
+		src.SetReadDeadline(time.Now().Add(spliceCheckInterval))
+		n, err := io.Copy(dst, src)
+		if n > 0 {
+			lastActive = time.Now()
+			t.Transfer(dir, int(n))
+		}
+		if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if time.Since(lastActive) >= relayIdleTimeout {
+			return errRelayIdle
+		}
+	}
+}
+
+// bidirectionalRelayRW relays between a client net.Conn carrying an encrypted
+// stream rw (e.g. a Shadowsocks conn wrapping it) and a plain remoteConn,
+// counting plaintext bytes against t.
+func bidirectionalRelayRW(conn net.Conn, rw io.ReadWriter, remoteConn net.Conn, t *userTraffic) {
 	closeOnce := sync.Once{}
 	closeAll := func() {
 		closeOnce.Do(func() {
@@ -68,51 +189,57 @@ func bidirectionalRelayRW(conn net.Conn, rw io.ReadWriter, remoteConn net.Conn)
 		})
 	}
 
-	go func() {
-		defer wg.Done()
-		relayRWWithTimeout(remoteConn, rw, conn) // remote -> cipher -> client
-		closeAll()
-	}()
-	go func() {
-		defer wg.Done()
-		relayRWWithTimeout2(rw, remoteConn, conn) // client -> cipher -> remote
-		closeAll()
-	}()
-
-	wg.Wait()
+	runRelay(closeAll,
+		relayDirection{ // remote -> cipher -> client
+			copy:       func() error { return relayRWWithTimeout(remoteConn, rw, t) },
+			closeWrite: func() bool { return closeWrite(conn) },
+		},
+		relayDirection{ // client -> cipher -> remote
+			copy:       func() error { return relayRWWithTimeout2(rw, remoteConn, conn, t) },
+			closeWrite: func() bool { return closeWrite(remoteConn) },
+		},
+	)
 }
 
 // relayRWWithTimeout: read from net.Conn (src), write to io.Writer (dst), with timeout on srcConn.
-func relayRWWithTimeout(srcConn net.Conn, dst io.Writer, deadlineConn net.Conn) {
+func relayRWWithTimeout(srcConn net.Conn, dst io.Writer, t *userTraffic) error {
 	buf := make([]byte, 32*1024)
 	for {
 		srcConn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
 		n, err := srcConn.Read(buf)
 		if n > 0 {
+			t.Transfer(trafficDown, n)
 			if _, wErr := dst.Write(buf[:n]); wErr != nil {
-				return
+				return wErr
 			}
 		}
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return
+			return err
 		}
 	}
 }
 
 // relayRWWithTimeout2: read from io.Reader (src), write to net.Conn (dst), with timeout on deadlineConn.
-func relayRWWithTimeout2(src io.Reader, dstConn net.Conn, deadlineConn net.Conn) {
+func relayRWWithTimeout2(src io.Reader, dstConn net.Conn, deadlineConn net.Conn, t *userTraffic) error {
 	buf := make([]byte, 32*1024)
 	for {
 		deadlineConn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
 		n, err := src.Read(buf)
 		if n > 0 {
+			t.Transfer(trafficUp, n)
 			dstConn.SetWriteDeadline(time.Now().Add(relayIdleTimeout))
 			if _, wErr := dstConn.Write(buf[:n]); wErr != nil {
-				return
+				return wErr
 			}
 		}
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			return
+			return err
 		}
 	}
 }
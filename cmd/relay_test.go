@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c := <-accepted
+	if c == nil {
+		tb.Fatal("accept failed")
+	}
+	tb.Cleanup(func() {
+		dialed.Close()
+		c.Close()
+	})
+	return dialed.(*net.TCPConn), c.(*net.TCPConn)
+}
+
+// halfCloseResponse is what the test server answers once the request ends:
+// large enough to outlast the socket buffers after the client's FIN.
+var halfCloseResponse = bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+
+var halfCloseRequest = []byte("request body")
+
+// serveAfterEOF reads the whole request from conn, then writes the response
+// and closes, as a server that needs the client's half-close would. The
+// outcome is sent on the returned channel.
+func serveAfterEOF(conn net.Conn) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		req, err := io.ReadAll(conn)
+		if err == nil && !bytes.Equal(req, halfCloseRequest) {
+			err = fmt.Errorf("server got %q, want %q", req, halfCloseRequest)
+		}
+		if err == nil {
+			_, err = conn.Write(halfCloseResponse)
+		}
+		done <- err
+	}()
+	return done
+}
+
+// waitFor fails the test if nothing arrives on done within a few seconds,
+// or if what arrives is an error.
+func waitFor[T any](t *testing.T, what string, done <-chan T) {
+	t.Helper()
+	select {
+	case v := <-done:
+		if err, ok := any(v).(error); ok && err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: timed out", what)
+	}
+}
+
+// runRelayTest starts relay in the background and returns a channel closed
+// when it returns.
+func runRelayTest(relay func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		relay()
+		close(done)
+	}()
+	return done
+}
+
+// checkHalfClose sends a request from client, half-closes it and checks the
+// whole response arrives.
+func checkHalfClose(t *testing.T, client io.ReadWriter, closeWrite func() error) {
+	t.Helper()
+	if _, err := client.Write(halfCloseRequest); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if !bytes.Equal(resp, halfCloseResponse) {
+		t.Fatalf("client got %d bytes, want %d", len(resp), len(halfCloseResponse))
+	}
+}
+
+func TestBidirectionalRelayHalfClose(t *testing.T) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	served := serveAfterEOF(server)
+	done := runRelayTest(func() { bidirectionalRelay(a, b, nil) })
+
+	checkHalfClose(t, client, client.CloseWrite)
+	waitFor(t, "server", served)
+	waitFor(t, "relay", done)
+}
+
+func TestBidirectionalSpliceHalfClose(t *testing.T) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	served := serveAfterEOF(server)
+	done := runRelayTest(func() { bidirectionalSplice(a, b, nil) })
+
+	checkHalfClose(t, client, client.CloseWrite)
+	waitFor(t, "server", served)
+	waitFor(t, "relay", done)
+}
+
+// aeadClient is the client end of a Shadowsocks AEAD stream. It bypasses
+// the library's process-wide salt filter, which would otherwise reject the
+// client's salt as a replay when the server side runs in the same process.
+type aeadClient struct {
+	conn net.Conn
+	ciph shadowaead.Cipher
+	w    io.Writer
+	r    io.Reader
+}
+
+func (c *aeadClient) Write(b []byte) (int, error) {
+	if c.w == nil {
+		salt := make([]byte, c.ciph.SaltSize())
+		rand.Read(salt)
+		aead, err := c.ciph.Encrypter(salt)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.conn.Write(salt); err != nil {
+			return 0, err
+		}
+		c.w = shadowaead.NewWriter(c.conn, aead)
+	}
+	return c.w.Write(b)
+}
+
+func (c *aeadClient) Read(b []byte) (int, error) {
+	if c.r == nil {
+		salt := make([]byte, c.ciph.SaltSize())
+		if _, err := io.ReadFull(c.conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.ciph.Decrypter(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.r = shadowaead.NewReader(c.conn, aead)
+	}
+	return c.r.Read(b)
+}
+
+func TestBidirectionalRelayRWHalfClose(t *testing.T) {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "test password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	served := serveAfterEOF(server)
+	done := runRelayTest(func() { bidirectionalRelayRW(a, ciph.StreamConn(a), b, nil) })
+
+	checkHalfClose(t, &aeadClient{conn: client, ciph: ciph.(shadowaead.Cipher)}, client.CloseWrite)
+	waitFor(t, "server", served)
+	waitFor(t, "relay", done)
+}
+
+// A destination that cannot be half-closed cannot be told the request
+// ended, so the relay must tear down both sides instead of hanging.
+func TestBidirectionalRelayNoCloseWrite(t *testing.T) {
+	client, a := tcpPair(t)
+	b, server := net.Pipe()
+	defer server.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, server)
+		close(drained)
+	}()
+	done := runRelayTest(func() { bidirectionalRelay(a, b, nil) })
+
+	if _, err := client.Write(halfCloseRequest); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "relay", done)
+	waitFor(t, "destination close", drained)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Errorf("client side not closed: %v", err)
+	}
+}
+
+// benchmarkRelay pushes b.N chunks from a client through relay to a server
+// that discards them, over loopback TCP.
+func benchmarkRelay(b *testing.B, relay func(a, c *net.TCPConn)) {
+	client, a := tcpPair(b)
+	c, server := tcpPair(b)
+	go relay(a, c)
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, server)
+		close(drained)
+	}()
+
+	chunk := make([]byte, 32*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.CloseWrite()
+	<-drained
+}
+
+func BenchmarkRelay(b *testing.B) {
+	benchmarkRelay(b, func(a, c *net.TCPConn) { bidirectionalRelay(a, c, nil) })
+}
+
+func BenchmarkSplice(b *testing.B) {
+	benchmarkRelay(b, func(a, c *net.TCPConn) { bidirectionalSplice(a, c, nil) })
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/riobard/go-bloom"
+)
+
+// Salt filter sizing, per user: ~10 slots of 10k salts at a 1e-6 false
+// positive rate keeps each filter around 350 KiB.
+const (
+	saltFilterCapacity = 100000
+	saltFilterSlots    = 10
+	saltFilterFPR      = 1e-6
+)
+
+var errReplayedSalt = errors.New("replayed salt")
+
+// saltFilter is a ring of Bloom filters remembering recently seen AEAD salts.
+// When the current slot fills up the oldest one is cleared, so memory stays
+// bounded and old salts eventually age out.
+type saltFilter struct {
+	mu       sync.Mutex
+	slots    []bloom.Filter
+	pos      int
+	count    int
+	perSlot  int
+	rejected atomic.Int64
+}
+
+func newSaltFilter() *saltFilter {
+	f := &saltFilter{
+		slots:   make([]bloom.Filter, saltFilterSlots),
+		perSlot: saltFilterCapacity / saltFilterSlots,
+	}
+	for i := range f.slots {
+		f.slots[i] = bloom.New(f.perSlot, saltFilterFPR, doubleFNV)
+	}
+	return f
+}
+
+// doubleFNV is the hash pair used by the Bloom filters.
+func doubleFNV(b []byte) (uint64, uint64) {
+	hx := fnv.New64()
+	hx.Write(b)
+	hy := fnv.New64a()
+	hy.Write(b)
+	return hx.Sum64(), hy.Sum64()
+}
+
+// Check reports whether salt was seen before, and records it if not.
+func (f *saltFilter) Check(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, s := range f.slots {
+		if s.Test(salt) {
+			return true
+		}
+	}
+
+	if f.count >= f.perSlot {
+		f.pos = (f.pos + 1) % len(f.slots)
+		f.slots[f.pos].Reset()
+		f.count = 0
+	}
+	f.slots[f.pos].Add(salt)
+	f.count++
+	return false
+}
+
+// Rejected returns how many replays this filter has refused.
+func (f *saltFilter) Rejected() int64 {
+	return f.rejected.Load()
+}
+
+// guard wraps a decrypting stream so that its first successful read fails if
+// salt is a replay. Only salts that authenticated are recorded, so garbage
+// from scanners cannot evict real entries.
+func (f *saltFilter) guard(ssConn net.Conn, salt []byte, user string) net.Conn {
+	return &saltGuardConn{Conn: ssConn, f: f, salt: salt, user: user}
+}
+
+type saltGuardConn struct {
+	net.Conn
+	f       *saltFilter
+	salt    []byte
+	user    string
+	checked bool
+}
+
+func (c *saltGuardConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.checked && n > 0 {
+		c.checked = true
+		if c.f.Check(c.salt) {
+			total := c.f.rejected.Add(1)
+			userLog(c.user).Warn("replayed salt rejected", logRemote, c.RemoteAddr().String(), "total", total)
+			return 0, errReplayedSalt
+		}
+	}
+	return n, err
+}
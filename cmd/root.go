@@ -8,8 +8,17 @@ import (
 )
 
 var rootCmd = &cobra.Command{
-	Use:   "hidexx",
-	Short: "Hidexx CLI tool",
+	Use:               "hidexx",
+	Short:             "Hidexx CLI tool",
+	PersistentPreRunE: setup,
+}
+
+// setup applies the global flags before any command runs.
+func setup(cmd *cobra.Command, args []string) error {
+	if err := setupLogging(cmd, args); err != nil {
+		return err
+	}
+	return setupState(cmd, args)
 }
 
 func Execute() {
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions besides upstream names. A route to upstreamDirect connects
+// directly; ruleReject refuses the destination.
+const ruleReject = "reject"
+
+func addRuleFlags(cmd *cobra.Command) {
+	cmd.Flags().String("rules", "", "YAML file of Clash-style routing rules under \"rules\", e.g. \"DOMAIN-SUFFIX,example.com,UPSTREAM\"; reloaded when it changes or on SIGHUP")
+}
+
+// routeRule sends matching destinations to an action: upstreamDirect,
+// ruleReject or the name of an upstream.
+type routeRule struct {
+	kind      string // DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-CIDR, DST-PORT or MATCH
+	domain    string // DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD
+	prefix    netip.Prefix
+	noResolve bool // IP-CIDR: do not look up domain destinations
+	portLo    int  // DST-PORT
+	portHi    int
+	action    string
+}
+
+// parseRouteRule parses one rule in Clash syntax: TYPE,VALUE,ACTION[,no-resolve]
+// or MATCH,ACTION. DIRECT and REJECT are accepted in any case.
+func parseRouteRule(line string) (routeRule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	kind := strings.ToUpper(fields[0])
+	if kind == "MATCH" {
+		if len(fields) != 2 {
+			return routeRule{}, fmt.Errorf("rule %q: want MATCH,ACTION", line)
+		}
+		return routeRule{kind: kind, action: ruleAction(fields[1])}, nil
+	}
+	if len(fields) < 3 || len(fields) > 4 {
+		return routeRule{}, fmt.Errorf("rule %q: want TYPE,VALUE,ACTION", line)
+	}
+	r := routeRule{kind: kind, action: ruleAction(fields[2])}
+	if len(fields) == 4 {
+		if kind != "IP-CIDR" && kind != "IP-CIDR6" || fields[3] != "no-resolve" {
+			return routeRule{}, fmt.Errorf("rule %q: unknown option %q", line, fields[3])
+		}
+		r.noResolve = true
+	}
+	value := fields[1]
+	switch kind {
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD":
+		r.domain = strings.ToLower(strings.TrimSuffix(value, "."))
+		if r.domain == "" {
+			return routeRule{}, fmt.Errorf("rule %q: empty domain", line)
+		}
+	case "IP-CIDR", "IP-CIDR6":
+		pfx, err := netip.ParsePrefix(value)
+		if err != nil {
+			return routeRule{}, fmt.Errorf("rule %q: invalid CIDR", line)
+		}
+		r.kind, r.prefix = "IP-CIDR", pfx.Masked()
+	case "DST-PORT":
+		lo, hi, isRange := strings.Cut(value, "-")
+		if !isRange {
+			hi = lo
+		}
+		var err1, err2 error
+		r.portLo, err1 = strconv.Atoi(lo)
+		r.portHi, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || r.portLo < 1 || r.portHi > 65535 || r.portLo > r.portHi {
+			return routeRule{}, fmt.Errorf("rule %q: invalid port or range", line)
+		}
+	default:
+		return routeRule{}, fmt.Errorf("rule %q: unsupported type %s (supported: DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-CIDR, IP-CIDR6, DST-PORT, MATCH)", line, fields[0])
+	}
+	return r, nil
+}
+
+// ruleAction normalises the built-in actions; upstream names are kept as
+// written.
+func ruleAction(s string) string {
+	switch strings.ToLower(s) {
+	case upstreamDirect, ruleReject:
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+// ruleTarget is a destination being routed. ips is filled by the first
+// IP-CIDR rule that needs a domain resolved.
+type ruleTarget struct {
+	host     string     // lower-case domain, "" for an IP destination
+	ip       netip.Addr // IP destination
+	port     int
+	ips      []netip.Addr
+	resolved bool
+}
+
+func newRuleTarget(target string) (*ruleTarget, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	t := &ruleTarget{}
+	t.port, _ = strconv.Atoi(portStr)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		t.ip = ip.Unmap()
+	} else {
+		t.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return t, nil
+}
+
+func (r *routeRule) match(ctx context.Context, t *ruleTarget) bool {
+	switch r.kind {
+	case "MATCH":
+		return true
+	case "DOMAIN":
+		return t.host == r.domain
+	case "DOMAIN-SUFFIX":
+		return matchDomain([]string{r.domain}, t.host)
+	case "DOMAIN-KEYWORD":
+		return t.host != "" && strings.Contains(t.host, r.domain)
+	case "DST-PORT":
+		return t.port >= r.portLo && t.port <= r.portHi
+	case "IP-CIDR":
+		if t.ip.IsValid() {
+			return r.prefix.Contains(t.ip)
+		}
+		if r.noResolve {
+			return false
+		}
+		if !t.resolved {
+			t.resolved = true
+			t.ips, _ = net.DefaultResolver.LookupNetIP(ctx, "ip", t.host)
+		}
+		for _, ip := range t.ips {
+			if r.prefix.Contains(ip.Unmap()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchRules returns the action of the first rule in rules that matches t.
+func matchRules(ctx context.Context, rules []routeRule, t *ruleTarget) (string, bool) {
+	for i := range rules {
+		if rules[i].match(ctx, t) {
+			return rules[i].action, true
+		}
+	}
+	return "", false
+}
+
+// ruleFile is the --rules file. Other keys, such as those of a full Clash
+// config, are ignored.
+type ruleFile struct {
+	Rules []string `yaml:"rules"`
+}
+
+// ruleSet is the hot-reloadable --rules file.
+type ruleSet struct {
+	path  string
+	check func(action string) error // rejects actions naming no upstream
+	rules atomic.Pointer[[]routeRule]
+}
+
+func newRuleSet(path string, check func(string) error) (*ruleSet, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &ruleSet{path: abs, check: check}
+	rules, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.rules.Store(&rules)
+	return s, nil
+}
+
+// load reads and checks the rules file.
+func (s *ruleSet) load() ([]routeRule, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var f ruleFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", s.path, err)
+	}
+	rules := make([]routeRule, 0, len(f.Rules))
+	for _, line := range f.Rules {
+		r, err := parseRouteRule(line)
+		if err == nil {
+			err = s.check(r.action)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Rules returns the rules in effect. A nil *ruleSet has none.
+func (s *ruleSet) Rules() []routeRule {
+	if s == nil {
+		return nil
+	}
+	return *s.rules.Load()
+}
+
+// reload swaps in the file's current rules; a broken file keeps the old ones.
+func (s *ruleSet) reload(reason string) {
+	rules, err := s.load()
+	if err != nil {
+		slog.Error("rules reload failed", "reason", reason, "path", s.path, "err", err)
+		return
+	}
+	s.rules.Store(&rules)
+	slog.Info("reloaded rules", "reason", reason, "path", s.path, "rules", len(rules))
+}
+
+// watch reloads the rules when their file changes or on SIGHUP, until lc
+// shuts down.
+func (s *ruleSet) watch(lc *lifecycle) {
+	watchFile(lc, s.path, "rules", s.reload)
+}
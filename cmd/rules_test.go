@@ -0,0 +1,397 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRouteRule(t *testing.T) {
+	tests := []struct {
+		line string
+		want routeRule
+	}{
+		{"DOMAIN,Example.com.,up", routeRule{kind: "DOMAIN", domain: "example.com", action: "up"}},
+		{"domain-suffix, example.com ,DIRECT", routeRule{kind: "DOMAIN-SUFFIX", domain: "example.com", action: upstreamDirect}},
+		{"DOMAIN-KEYWORD,google,Reject", routeRule{kind: "DOMAIN-KEYWORD", domain: "google", action: ruleReject}},
+		{"IP-CIDR,10.1.2.3/8,up", routeRule{kind: "IP-CIDR", prefix: netip.MustParsePrefix("10.0.0.0/8"), action: "up"}},
+		{"IP-CIDR,192.168.0.0/16,up,no-resolve", routeRule{kind: "IP-CIDR", prefix: netip.MustParsePrefix("192.168.0.0/16"), noResolve: true, action: "up"}},
+		{"IP-CIDR6,2001:db8::/32,up,no-resolve", routeRule{kind: "IP-CIDR", prefix: netip.MustParsePrefix("2001:db8::/32"), noResolve: true, action: "up"}},
+		{"DST-PORT,443,up", routeRule{kind: "DST-PORT", portLo: 443, portHi: 443, action: "up"}},
+		{"DST-PORT,8000-8080,DIRECT", routeRule{kind: "DST-PORT", portLo: 8000, portHi: 8080, action: upstreamDirect}},
+		{"MATCH,up", routeRule{kind: "MATCH", action: "up"}},
+	}
+	for _, tt := range tests {
+		got, err := parseRouteRule(tt.line)
+		if err != nil {
+			t.Errorf("parseRouteRule(%q): %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRouteRule(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseRouteRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"MATCH",
+		"MATCH,up,extra",
+		"DOMAIN,example.com",
+		"DOMAIN,,up",
+		"DOMAIN,example.com,up,no-resolve",
+		"IP-CIDR,10.0.0.0/8,up,resolve",
+		"IP-CIDR,10.0.0.0,up",
+		"DST-PORT,0,up",
+		"DST-PORT,80-65536,up",
+		"DST-PORT,90-80,up",
+		"DST-PORT,http,up",
+		"GEOIP,CN,DIRECT",
+	} {
+		if r, err := parseRouteRule(line); err == nil {
+			t.Errorf("parseRouteRule(%q) = %+v, want error", line, r)
+		}
+	}
+}
+
+func mustRules(t *testing.T, lines ...string) []routeRule {
+	t.Helper()
+	rules := make([]routeRule, 0, len(lines))
+	for _, line := range lines {
+		r, err := parseRouteRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func TestMatchRules(t *testing.T) {
+	rules := mustRules(t,
+		"DOMAIN,api.example.com,first",
+		"DOMAIN-SUFFIX,example.com,second",
+		"DOMAIN-KEYWORD,ads,third",
+		"IP-CIDR,10.0.0.0/8,fourth,no-resolve",
+		"DST-PORT,25,fifth",
+		"MATCH,last",
+	)
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"api.example.com:443", "first"}, // also matches the suffix rule below
+		{"www.example.com:25", "second"}, // before DST-PORT
+		{"example.com:443", "second"},
+		{"ads.example.org:443", "third"},
+		{"10.2.3.4:25", "fourth"}, // before DST-PORT
+		{"[::ffff:10.2.3.4]:80", "fourth"},
+		{"mail.example.org:25", "fifth"},
+		{"notexample.com:443", "last"},
+		{"10.example.org:443", "last"}, // no-resolve: domains never match IP-CIDR
+	}
+	for _, tt := range tests {
+		rt, err := newRuleTarget(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := matchRules(context.Background(), rules, rt)
+		if !ok || got != tt.want {
+			t.Errorf("matchRules(%s) = %q, %v, want %q", tt.target, got, ok, tt.want)
+		}
+	}
+
+	rt, _ := newRuleTarget("example.net:80")
+	if got, ok := matchRules(context.Background(), rules[:5], rt); ok {
+		t.Errorf("matchRules without MATCH = %q, want no match", got)
+	}
+}
+
+// fakeUpstream is an upstreamDialer that records the targets it is asked
+// for and hands back one end of a pipe.
+type fakeUpstream struct {
+	name  string
+	mu    sync.Mutex
+	dials []string
+}
+
+func (f *fakeUpstream) DialContext(_ context.Context, target string) (net.Conn, error) {
+	f.mu.Lock()
+	f.dials = append(f.dials, target)
+	f.mu.Unlock()
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+// takeDials returns and forgets the targets dialed so far.
+func (f *fakeUpstream) takeDials() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.dials
+	f.dials = nil
+	return d
+}
+
+func TestUpstreamSetPick(t *testing.T) {
+	home, work := &fakeUpstream{name: "home"}, &fakeUpstream{name: "work"}
+	s := &upstreamSet{
+		named: map[string]upstreamDialer{"home": home, "work": work},
+		routes: mustRules(t,
+			"DOMAIN-SUFFIX,corp.example,work",
+			"DOMAIN-SUFFIX,blocked.example,REJECT",
+			"DOMAIN-SUFFIX,local.example,DIRECT",
+		),
+	}
+	tests := []struct {
+		target   string
+		fallback string
+		want     upstreamDialer
+		wantName string
+	}{
+		{"git.corp.example:22", "", work, "work"},
+		{"git.corp.example:22", "home", work, "work"}, // rules beat the user's upstream
+		{"nas.local.example:443", "home", nil, ""},
+		{"example.org:443", "home", home, "home"},
+		{"example.org:443", upstreamDirect, nil, ""},
+		{"example.org:443", "", nil, ""},
+	}
+	for _, tt := range tests {
+		name, d, err := s.pick(context.Background(), tt.fallback, tt.target)
+		if err != nil {
+			t.Errorf("pick(%q, %s): %v", tt.fallback, tt.target, err)
+			continue
+		}
+		if name != tt.wantName || d != tt.want {
+			t.Errorf("pick(%q, %s) = %q, %p, want %q, %p", tt.fallback, tt.target, name, d, tt.wantName, tt.want)
+		}
+	}
+
+	_, _, err := s.pick(context.Background(), "home", "www.blocked.example:443")
+	var denied *aclDeniedError
+	if !errors.As(err, &denied) || denied.rule != ruleReject {
+		t.Errorf("pick on a REJECT rule: err = %v, want reject", err)
+	}
+
+	var none *upstreamSet
+	if name, d, err := none.pick(context.Background(), "", "example.org:443"); name != "" || d != nil || err != nil {
+		t.Errorf("nil set pick = %q, %v, %v, want direct", name, d, err)
+	}
+}
+
+func TestEgressDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	home, work := &fakeUpstream{name: "home"}, &fakeUpstream{name: "work"}
+	ups := &upstreamSet{
+		named: map[string]upstreamDialer{"home": home, "work": work},
+		routes: mustRules(t,
+			"DOMAIN-SUFFIX,corp.example,work",
+			"DOMAIN-SUFFIX,blocked.example,REJECT",
+			"IP-CIDR,127.0.0.0/8,DIRECT",
+		),
+	}
+	acl, err := newDestPolicy(aclRules{Deny: []string{"denied.example"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newEgress(nil, ups, "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guarded, err := newEgress(acl, ups, "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		out      *egress
+		target   string
+		wantHome []string
+		wantWork []string
+		wantRule string // aclDeniedError rule, "" for success
+	}{
+		{e, "example.org:443", []string{"example.org:443"}, nil, ""},
+		{e, "git.corp.example:22", nil, []string{"git.corp.example:22"}, ""},
+		{e, "www.blocked.example:443", nil, nil, ruleReject},
+		{e, ln.Addr().String(), nil, nil, ""}, // DIRECT: reaches the local listener
+		{guarded, "www.denied.example:80", nil, nil, "deny"},
+		{guarded, "example.org:80", []string{"example.org:80"}, nil, ""},
+	}
+	for _, tt := range tests {
+		conn, err := tt.out.Dial(tt.target)
+		var denied *aclDeniedError
+		switch {
+		case tt.wantRule != "":
+			if !errors.As(err, &denied) || denied.rule != tt.wantRule {
+				t.Errorf("Dial(%s): err = %v, want rule %q", tt.target, err, tt.wantRule)
+			}
+		case err != nil:
+			t.Errorf("Dial(%s): %v", tt.target, err)
+		default:
+			conn.Close()
+		}
+		if got := home.takeDials(); !equalStrings(got, tt.wantHome) {
+			t.Errorf("Dial(%s): home dialed %q, want %q", tt.target, got, tt.wantHome)
+		}
+		if got := work.takeDials(); !equalStrings(got, tt.wantWork) {
+			t.Errorf("Dial(%s): work dialed %q, want %q", tt.target, got, tt.wantWork)
+		}
+	}
+
+	if _, err := newEgress(nil, ups, "missing"); err == nil {
+		t.Error("newEgress with an unknown upstream: want error")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeRules writes a --rules file holding lines.
+func writeRules(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	data := "rules:\n"
+	for _, line := range lines {
+		data += "  - " + line + "\n"
+	}
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestRuleSet(t *testing.T, lines ...string) *ruleSet {
+	t.Helper()
+	ups := &upstreamSet{named: map[string]upstreamDialer{"home": &fakeUpstream{name: "home"}}}
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	writeRules(t, path, lines...)
+	rs, err := newRuleSet(path, ups.checkAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func ruleActions(rules []routeRule) []string {
+	var out []string
+	for _, r := range rules {
+		out = append(out, r.action)
+	}
+	return out
+}
+
+func TestRuleSetLoad(t *testing.T) {
+	rs := newTestRuleSet(t, "DOMAIN-SUFFIX,example.com,home", "DST-PORT,25,REJECT", "MATCH,DIRECT")
+	if got, want := ruleActions(rs.Rules()), []string{"home", ruleReject, upstreamDirect}; !equalStrings(got, want) {
+		t.Errorf("loaded actions %q, want %q", got, want)
+	}
+
+	ups := &upstreamSet{named: map[string]upstreamDialer{}}
+	dir := t.TempDir()
+	for name, lines := range map[string][]string{
+		"bad rule":         {"GEOIP,CN,DIRECT"},
+		"unknown upstream": {"MATCH,nowhere"},
+	} {
+		path := filepath.Join(dir, "rules.yaml")
+		writeRules(t, path, lines...)
+		if _, err := newRuleSet(path, ups.checkAction); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("rules: [unclosed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRuleSet(filepath.Join(dir, "broken.yaml"), ups.checkAction); err == nil {
+		t.Error("invalid YAML: want error")
+	}
+	if _, err := newRuleSet(filepath.Join(dir, "missing.yaml"), ups.checkAction); err == nil {
+		t.Error("missing file: want error")
+	}
+}
+
+func TestRuleSetReload(t *testing.T) {
+	rs := newTestRuleSet(t, "MATCH,home")
+
+	writeRules(t, rs.path, "DOMAIN,example.com,REJECT", "MATCH,DIRECT")
+	rs.reload("test")
+	if got, want := ruleActions(rs.Rules()), []string{ruleReject, upstreamDirect}; !equalStrings(got, want) {
+		t.Fatalf("after reload: actions %q, want %q", got, want)
+	}
+
+	// A broken file keeps the rules in effect.
+	for _, lines := range [][]string{{"GEOIP,CN,DIRECT"}, {"MATCH,nowhere"}} {
+		writeRules(t, rs.path, lines...)
+		rs.reload("test")
+		if got, want := ruleActions(rs.Rules()), []string{ruleReject, upstreamDirect}; !equalStrings(got, want) {
+			t.Errorf("after reloading %q: actions %q, want the old %q", lines, got, want)
+		}
+	}
+	os.Remove(rs.path)
+	rs.reload("test")
+	if len(rs.Rules()) != 2 {
+		t.Errorf("after the file was removed: %d rules, want the old 2", len(rs.Rules()))
+	}
+}
+
+func TestRuleSetWatch(t *testing.T) {
+	rs := newTestRuleSet(t, "MATCH,home")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lc := &lifecycle{ctx: ctx, stop: cancel, conns: make(map[net.Conn]struct{})}
+	go rs.watch(lc)
+	time.Sleep(100 * time.Millisecond) // let the watcher start
+
+	waitActions := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !equalStrings(ruleActions(rs.Rules()), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("actions %q, want %q", ruleActions(rs.Rules()), want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	writeRules(t, rs.path, "MATCH,REJECT")
+	waitActions(ruleReject)
+
+	// Replaced by rename, as editors and atomic writers do.
+	tmp := rs.path + ".tmp"
+	writeRules(t, tmp, "DST-PORT,80,home", "MATCH,DIRECT")
+	if err := os.Rename(tmp, rs.path); err != nil {
+		t.Fatal(err)
+	}
+	waitActions("home", upstreamDirect)
+
+	writeRules(t, rs.path, "MATCH,nowhere")
+	time.Sleep(2 * reloadDebounce)
+	waitActions("home", upstreamDirect)
+}
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,24 +25,45 @@ var serveCmd = &cobra.Command{
 func init() {
 	serveCmd.Flags().StringP("port", "p", "51991", "HTTP server listen port")
 	serveCmd.Flags().String("line", "1", `line_id: "1" for 王者套餐, "11" for 青铜套餐`)
-	serveCmd.Flags().IntP("users", "n", 1, "number of users (each gets an independent subscription)")
+	serveCmd.Flags().IntP("users", "n", 1, "number of users if "+usersFile+" does not exist (each gets an independent subscription)")
+	addAdminFlag(serveCmd)
+	addDrainFlag(serveCmd)
 
 	rootCmd.AddCommand(serveCmd)
 }
 
 type subStore struct {
-	mu    sync.RWMutex
-	slots [][]byte // slots[0] = user 1, slots[1] = user 2, ...
+	names   []string // user of each slot
+	mu      sync.RWMutex
+	slots   [][]byte    // slots[i] belongs to names[i]
+	updated []time.Time // when each slot was last Set
 }
 
-func newSubStore(n int) *subStore {
-	return &subStore{slots: make([][]byte, n)}
+func newSubStore(names []string) *subStore {
+	n := len(names)
+	return &subStore{names: names, slots: make([][]byte, n), updated: make([]time.Time, n)}
+}
+
+// Name returns the user slot index belongs to.
+func (s *subStore) Name(index int) string {
+	return s.names[index]
 }
 
 func (s *subStore) Set(index int, data []byte) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.slots[index] = data
+	s.updated[index] = time.Now()
+}
+
+// Age returns how long ago slot index was filled, or false if it is empty.
+func (s *subStore) Age(index int) (time.Duration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if index < 0 || index >= len(s.slots) || s.slots[index] == nil {
+		return 0, false
+	}
+	return time.Since(s.updated[index]), true
 }
 
 func (s *subStore) Get(index int) []byte {
@@ -63,46 +87,80 @@ func runServe(cmd *cobra.Command, args []string) {
 		numUsers = 1
 	}
 
-	store := newSubStore(numUsers)
+	// serve only reads the registry; ss and proxy create and extend it.
+	users, err := loadUserRegistry(statePath(usersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		users, err = newUserRegistry(numUsers, 0, nil), nil
+	}
+	if err != nil {
+		fatal("cannot load users", "path", statePath(usersFile), "err", err)
+	}
+	var names []string
+	for _, e := range users.Enabled() {
+		names = append(names, e.Name)
+	}
+	if len(names) == 0 {
+		fatal("no enabled users", "path", statePath(usersFile))
+	}
+
+	store := newSubStore(names)
+	registerGaugeFunc("hidexx_subscription_age_seconds", "Time since each user's subscription was renewed.",
+		func(emit func(float64, ...string)) {
+			for i := 0; i < store.Len(); i++ {
+				if age, ok := store.Age(i); ok {
+					emit(age.Seconds(), store.Name(i))
+				}
+			}
+		}, "user")
+	lc := lifecycleFromFlags(cmd)
+	startAdminFromFlags(cmd, lc)
 
 	// 启动时立即执行
-	refreshAll(store, lineID)
+	ctx := lc.Context()
+	refreshAll(ctx, store, lineID)
 
 	// 后台定时刷新
 	go func() {
 		for {
-			interval := nextRefreshInterval(store)
-			time.Sleep(interval)
-			refreshAll(store, lineID)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(nextRefreshInterval(store)):
+			}
+			refreshAll(ctx, store, lineID)
 		}
 	}()
 
 	// HTTP 服务
 	mux := http.NewServeMux()
 
-	// 每个用户一个独立 endpoint: /1/sub.yaml, /2/sub.yaml, ...
-	for i := 0; i < numUsers; i++ {
-		idx := i
-		userID := i + 1
-		path := fmt.Sprintf("/%d/sub.yaml", userID)
-
-		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("[access] %s %s from %s - UA: %s", r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+	// 每个用户一个独立 endpoint: /alice/sub.yaml, /bob/sub.yaml, ...
+	for i, name := range names {
+		idx, name := i, name
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			logAccess(r, name)
+			countSubscriptionRequest(name, r.UserAgent())
 			data := store.Get(idx)
 			if data == nil {
 				http.Error(w, "subscription not ready yet, try again later", http.StatusServiceUnavailable)
 				return
 			}
 			w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=hidexx-%d.yaml", userID))
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=hidexx-%s.yaml", name))
 			w.Write(data)
-			log.Printf("[access] served %d bytes to %s (user %d)", len(data), r.RemoteAddr, userID)
-		})
+			slog.Debug("subscription served", logUser, name, logRemote, r.RemoteAddr, logBytes, len(data))
+		}
+		mux.HandleFunc("/"+name+"/sub.yaml", handler)
+		// 兼容改名前的 /N/sub.yaml
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, "user")); err == nil && name == "user"+strconv.Itoa(n) {
+			mux.HandleFunc(fmt.Sprintf("/%d/sub.yaml", n), handler)
+		}
 	}
 
-	// 兼容旧的单用户路径，指向 user 1
+	// 兼容旧的单用户路径，指向第一个用户
 	mux.HandleFunc("/sub.yaml", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[access] %s %s from %s - UA: %s", r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+		logAccess(r, names[0])
+		countSubscriptionRequest(names[0], r.UserAgent())
 		data := store.Get(0)
 		if data == nil {
 			http.Error(w, "subscription not ready yet, try again later", http.StatusServiceUnavailable)
@@ -115,52 +173,76 @@ func runServe(cmd *cobra.Command, args []string) {
 
 	// 状态页
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[access] %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		logAccess(r, "")
 		fmt.Fprintln(w, "hidexx subscription server")
-		fmt.Fprintf(w, "users: %d\n\n", numUsers)
-		for i := 0; i < numUsers; i++ {
+		fmt.Fprintf(w, "users: %d\n\n", len(names))
+		for i, name := range names {
 			data := store.Get(i)
 			status := "not ready"
 			if data != nil {
 				status = fmt.Sprintf("OK (%d bytes)", len(data))
 			}
-			fmt.Fprintf(w, "  user %d: %s  ->  /%d/sub.yaml\n", i+1, status, i+1)
+			fmt.Fprintf(w, "  user %s: %s  ->  /%s/sub.yaml\n", name, status, name)
 		}
 	})
 
 	localIP := getLocalIP()
 	addr := "0.0.0.0:" + port
+	if err := lc.ListenAndServe(&http.Server{Addr: addr, Handler: mux}); err != nil {
+		fatal("HTTP server failed", "addr", addr, "err", err)
+	}
 	fmt.Println("=== hidexx subscription server ===")
 	fmt.Println()
 	fmt.Printf("listening on %s\n", addr)
-	fmt.Printf("users: %d\n", numUsers)
+	fmt.Printf("users: %d\n", len(names))
 	fmt.Println()
 	fmt.Println("subscription URLs (one per person, configure once):")
-	for i := 0; i < numUsers; i++ {
-		fmt.Printf("  user %d: http://%s:%s/%d/sub.yaml\n", i+1, localIP, port, i+1)
+	for _, name := range names {
+		fmt.Printf("  user %s: http://%s:%s/%s/sub.yaml\n", name, localIP, port, name)
 	}
 	fmt.Println()
 	fmt.Println("subscription will auto-renew every ~20 hours.")
 
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		fmt.Fprintf(os.Stderr, "http server error: %v\n", err)
-		os.Exit(1)
+	os.Exit(lc.Wait())
+}
+
+// logAccess logs one HTTP request; user is "" for pages not tied to a user.
+func logAccess(r *http.Request, user string) {
+	args := []any{"method", r.Method, "path", r.URL.Path, logRemote, r.RemoteAddr, "ua", r.UserAgent()}
+	if user != "" {
+		args = append(args, logUser, user)
 	}
+	slog.Info("http request", args...)
 }
 
-func refreshAll(store *subStore, lineID string) {
+// refreshAll renews every slot in turn, stopping early if ctx is cancelled.
+func refreshAll(ctx context.Context, store *subStore, lineID string) {
 	for i := 0; i < store.Len(); i++ {
-		userID := i + 1
-		log.Printf("[user %d] starting daily renewal...", userID)
-		if err := refreshOne(store, i, lineID); err != nil {
-			log.Printf("[user %d] refresh failed: %v, will retry next cycle", userID, err)
+		if ctx.Err() != nil {
+			return
+		}
+		lg := userLog(store.Name(i))
+		lg.Info("starting daily renewal")
+		if err := refreshOne(ctx, store, i, lineID); err != nil {
+			lg.Error("refresh failed, will retry next cycle", "err", err)
 		}
 		if i < store.Len()-1 {
-			time.Sleep(5 * time.Second)
+			sleepCtx(ctx, 5*time.Second)
 		}
 	}
 }
 
+// sleepCtx sleeps for d, or less if ctx is cancelled, and reports whether
+// the full time passed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
 func nextRefreshInterval(store *subStore) time.Duration {
 	for i := 0; i < store.Len(); i++ {
 		if store.Get(i) == nil {
@@ -170,9 +252,8 @@ func nextRefreshInterval(store *subStore) time.Duration {
 	return 20 * time.Hour
 }
 
-func refreshOne(store *subStore, index int, lineID string) error {
-	userID := index + 1
-	tag := "[user " + strconv.Itoa(userID) + "]"
+func refreshOne(ctx context.Context, store *subStore, index int, lineID string) error {
+	lg := userLog(store.Name(index))
 
 	c, err := client.New("https://a.hidexx.com")
 	if err != nil {
@@ -180,18 +261,20 @@ func refreshOne(store *subStore, index int, lineID string) error {
 	}
 
 	email, password := client.GenerateRandomAccount()
-	log.Printf("%s registering %s ...", tag, email)
+	lg.Info("registering", "email", email)
 	if err := c.Register(email, password); err != nil {
 		return fmt.Errorf("register: %w", err)
 	}
-	log.Printf("%s register success", tag)
+	lg.Info("register success")
 
-	log.Printf("%s claiming free trial ...", tag)
+	lg.Info("claiming free trial")
 	if err := c.ClaimFreeTrial(lineID); err != nil {
 		return fmt.Errorf("claim: %w", err)
 	}
-	log.Printf("%s claim success, waiting 10s for provisioning...", tag)
-	time.Sleep(10 * time.Second)
+	lg.Info("claim success, waiting 10s for provisioning")
+	if !sleepCtx(ctx, 10*time.Second) {
+		return ctx.Err()
+	}
 
 	subs, err := c.GetSubscriptions()
 	if err != nil {
@@ -202,13 +285,13 @@ func refreshOne(store *subStore, index int, lineID string) error {
 	}
 
 	subURL := subs[0].URL
-	log.Printf("%s downloading subscription: %s", tag, subURL)
+	lg.Info("downloading subscription", "url", redactURL(subURL))
 	data, err := client.DownloadSubscriptionYAML(subURL)
 	if err != nil {
 		return fmt.Errorf("download yaml: %w", err)
 	}
 
 	store.Set(index, data)
-	log.Printf("%s done! serving %d bytes. account: %s / %s", tag, len(data), email, password)
+	lg.Info("subscription renewed", logBytes, len(data), "email", email, "password", secret(password))
 	return nil
 }
@@ -4,16 +4,15 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
 	"time"
 
-	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"github.com/spf13/cobra"
 )
@@ -25,10 +24,25 @@ var ssCmd = &cobra.Command{
 }
 
 func init() {
-	ssCmd.Flags().IntP("users", "n", 2, "number of proxy ports")
+	ssCmd.Flags().IntP("users", "n", 2, "number of users to create if "+usersFile+" does not exist yet")
 	ssCmd.Flags().IntP("port", "p", 51801, "starting port")
 	ssCmd.Flags().String("http", "51800", "HTTP port for Clash YAML subscription")
-	ssCmd.Flags().StringP("method", "m", "AEAD_AES_256_GCM", "encryption method")
+	ssCmd.Flags().StringP("method", "m", defaultSSMethod, "encryption method")
+	ssCmd.Flags().Bool("single-port", false, "serve all users from --port instead of one port per user")
+	ssCmd.Flags().String("on-fail", failDrain, "handshake failure behaviour: close, drain or fallback")
+	ssCmd.Flags().String("fallback", "", "decoy host:port that failed handshakes are forwarded to (with --on-fail=fallback)")
+	ssCmd.Flags().String("plugin", "", "SIP003 plugin run in front of each port, e.g. obfs-server or v2ray-plugin")
+	ssCmd.Flags().String("plugin-opts", "", "server plugin options, e.g. \"obfs=http\" or \"server;mode=websocket\"")
+	ssCmd.Flags().String("plugin-client-opts", "", "plugin options for generated client configs (default: derived from --plugin-opts)")
+
+	addTrafficFlags(ssCmd)
+	addLimitFlags(ssCmd)
+	addACLFlags(ssCmd)
+	addGuardFlags(ssCmd)
+	addUpstreamFlags(ssCmd)
+	addRuleFlags(ssCmd)
+	addAdminFlag(ssCmd)
+	addDrainFlag(ssCmd)
 
 	rootCmd.AddCommand(ssCmd)
 }
@@ -37,26 +51,91 @@ func runSS(cmd *cobra.Command, args []string) {
 	numUsers, _ := cmd.Flags().GetInt("users")
 	basePort, _ := cmd.Flags().GetInt("port")
 	method, _ := cmd.Flags().GetString("method")
+	singlePort, _ := cmd.Flags().GetBool("single-port")
+	onFail, _ := cmd.Flags().GetString("on-fail")
+	fallback, _ := cmd.Flags().GetString("fallback")
+
+	m, err := lookupSSMethod(method)
+	if err != nil {
+		fatal("invalid method", "method", method, "err", err)
+	}
+	if err := checkStateDir(); err != nil {
+		fatal("unusable state directory", "path", stateDir, "err", err)
+	}
+	policy, err := newFailPolicy(onFail, fallback)
+	if err != nil {
+		fatal("invalid --on-fail", "on_fail", onFail, "err", err)
+	}
+	traffic, err := trafficStoreFromFlags(cmd, "ss")
+	if err != nil {
+		fatal("cannot set up traffic accounting", "err", err)
+	}
+	limits, err := connLimitsFromFlags(cmd)
+	if err != nil {
+		fatal("invalid connection limits", "err", err)
+	}
+	acl, err := destACLFromFlags(cmd)
+	if err != nil {
+		fatal("invalid destination ACL", "err", err)
+	}
+	upstreams, err := upstreamSetFromFlags(cmd)
+	if err != nil {
+		fatal("invalid upstreams", "err", err)
+	}
+	lc := lifecycleFromFlags(cmd)
+	lc.OnShutdown(func() { saveTraffic(traffic) })
+	lc.Run(func() { traffic.saveEvery(lc.Context()) })
+	go upstreams.WatchRules(lc)
+	guard, err := clientGuardFromFlags(cmd, startAdminFromFlags(cmd, lc))
+	if err != nil {
+		fatal("invalid client guard settings", "err", err)
+	}
+	lc.Run(func() { guard.sweepEvery(lc.Context()) })
+	opts := &ssOptions{method: m, policy: policy, traffic: traffic, limits: limits, acl: acl, upstreams: upstreams, guard: guard, lc: lc}
+	if name, _ := cmd.Flags().GetString("plugin"); name != "" {
+		pluginOpts, _ := cmd.Flags().GetString("plugin-opts")
+		clientOpts, _ := cmd.Flags().GetString("plugin-client-opts")
+		if opts.plugin, err = newSIP003Plugin(name, pluginOpts, clientOpts); err != nil {
+			fatal("cannot set up plugin", "plugin", name, "err", err)
+		}
+		// The plugin connects to us from 127.0.0.1, so client addresses
+		// are not known here.
+		if guard.HasAllowlist() {
+			fatal("client allowlists cannot be used with --plugin, which hides client addresses", "plugin", name)
+		}
+	}
+	pluginParam, pluginYAML := "", ""
+	if opts.plugin != nil {
+		pluginParam, pluginYAML = opts.plugin.URLParam(), opts.plugin.ClashYAML()
+	}
 
 	fmt.Println("=== hidexx Shadowsocks server ===")
 	fmt.Println()
 
 	publicIP := getPublicIP()
-	passwords := loadOrGeneratePasswords(numUsers)
-
-	ssMethod := "aes-256-gcm"
+	unlock, err := lockUsers()
+	if err != nil {
+		fatal("cannot lock users", "path", statePath(usersFile), "err", err)
+	}
+	users, err := loadOrCreateUsers(numUsers, basePort, legacySSUsers(basePort))
+	if err != nil {
+		fatal("cannot load users", "path", statePath(usersFile), "err", err)
+	}
 
-	for i := 0; i < numUsers; i++ {
-		port := basePort + i
-		userID := i + 1
-		pw := passwords[i]
-		go startSS(port, userID, method, pw)
+	srv := newSSServer(opts, basePort, singlePort)
+	if err := srv.prepare(users); err != nil {
+		fatal("cannot save users", "path", statePath(usersFile), "err", err)
+	}
+	unlock()
+	if err := srv.start(users); err != nil {
+		fatal("cannot start Shadowsocks server", "err", err)
+	}
+	go srv.watchUsers(lc)
 
-		raw := fmt.Sprintf("%s:%s", ssMethod, pw)
-		encoded := base64.StdEncoding.EncodeToString([]byte(raw))
-		ssURL := fmt.Sprintf("ss://%s@%s:%d#hidexx-user%d", encoded, publicIP, port, userID)
+	for _, u := range srv.Users() {
+		ssURL := u.Method.URL(u.Password, publicIP, u.Port, pluginParam, "hidexx-"+u.Name)
 
-		fmt.Printf("  user %d:\n", userID)
+		fmt.Printf("  user %s:\n", u.Name)
 		fmt.Printf("    one-click URL: %s\n", ssURL)
 		fmt.Println()
 	}
@@ -65,152 +144,197 @@ func runSS(cmd *cobra.Command, args []string) {
 	httpPort, _ := cmd.Flags().GetString("http")
 
 	mux := http.NewServeMux()
-	for i := 0; i < numUsers; i++ {
-		idx := i
-		port := basePort + idx
-		pw := passwords[idx]
-		userID := idx + 1
-		path := fmt.Sprintf("/%d/clash.yaml", userID)
-
-		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-			yaml := fmt.Sprintf(`mixed-port: 7890
+	mux.Handle("/", srv.clashHandler(func(u ssUserInfo) string {
+		return fmt.Sprintf(`mixed-port: 7890
 allow-lan: false
 mode: rule
 log-level: info
 
 proxies:
-  - name: hidexx-user%d
+  - name: hidexx-%s
     type: ss
     server: %s
     port: %d
-    cipher: aes-256-gcm
+    cipher: %s
     password: "%s"
-
+    udp: %t
+%s
 proxy-groups:
   - name: PROXY
     type: select
     proxies:
-      - hidexx-user%d
+      - hidexx-%s
 
 rules:
   - GEOIP,CN,DIRECT
   - MATCH,PROXY
-`, userID, publicIP, port, pw, userID)
+`, u.Name, publicIP, u.Port, u.Method.Client, u.Password, u.Method.UDP(), pluginYAML, u.Name)
+	}))
 
-			w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
-			w.Write([]byte(yaml))
-		})
+	addr := "0.0.0.0:" + httpPort
+	if err := lc.ListenAndServe(&http.Server{Addr: addr, Handler: mux}); err != nil {
+		fatal("Clash HTTP server failed", "addr", addr, "err", err)
 	}
-
-	go func() {
-		addr := "0.0.0.0:" + httpPort
-		log.Printf("Clash subscription HTTP server on %s", addr)
-		if err := http.ListenAndServe(addr, mux); err != nil {
-			log.Fatalf("Clash HTTP server failed: %v", err)
-		}
-	}()
+	slog.Info("Clash subscription HTTP server listening", "addr", addr)
 
 	fmt.Println("Clash subscription URLs (for Android Clash):")
-	for i := 0; i < numUsers; i++ {
-		fmt.Printf("  user %d: http://%s:%s/%d/clash.yaml\n", i+1, publicIP, httpPort, i+1)
+	for _, u := range srv.Users() {
+		fmt.Printf("  user %s: http://%s:%s/%s/clash.yaml\n", u.Name, publicIP, httpPort, u.Name)
 	}
 	fmt.Println()
+	fmt.Println("users reload on SIGHUP or when " + statePath(usersFile) + " changes")
 	fmt.Println("server running...")
 
-	select {}
+	os.Exit(lc.Wait())
 }
 
-func startSS(port, userID int, method, password string) {
-	ciph, err := core.PickCipher(method, nil, password)
-	if err != nil {
-		log.Fatalf("[user %d] cipher error: %v", userID, err)
-	}
+// ssOptions are the server settings shared by every Shadowsocks listener.
+type ssOptions struct {
+	method    *ssMethod
+	policy    *failPolicy
+	plugin    *sip003Plugin // nil without --plugin
+	traffic   *trafficStore
+	limits    *connLimits
+	acl       *destACL
+	upstreams *upstreamSet // nil without --upstream
+	guard     *clientGuard
+	lc        *lifecycle
+}
 
-	addr := "0.0.0.0:" + strconv.Itoa(port)
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("[user %d] listen %s: %v", userID, addr, err)
-	}
-	log.Printf("[user %d] Shadowsocks (%s) listening on %s", userID, method, addr)
+// handleSS serves one client of a per-user port. Replayed AEAD handshakes are
+// rejected through u.salts; policy decides what a failed handshake sees, and
+// guard counts it against the client's address. release gives back the
+// connection's limiter slot early, see failPolicy.apply.
+func handleSS(conn net.Conn, u *ssUser, policy *failPolicy, guard *clientGuard, release func()) {
+	defer conn.Close()
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Printf("[user %d] accept: %v", userID, err)
-			continue
+	rc := newRecordConn(conn)
+	rc.SetReadDeadline(time.Now().Add(ssHandshakeTimeout))
+
+	var err error
+	if u.salts == nil {
+		err = serveSSStream(rc, u.ciph.StreamConn(rc), u)
+	} else {
+		salt := make([]byte, u.aead.SaltSize())
+		if _, err = io.ReadFull(rc, salt); err == nil {
+			pc := newPrefixConn(rc, salt)
+			err = serveSSStream(pc, u.salts.guard(u.ciph.StreamConn(pc), salt, u.name), u)
 		}
-		go handleSS(conn, ciph)
+	}
+	if err != nil {
+		countSSHandshakeFailure(err)
+		guard.Fail(conn.RemoteAddr(), "ss")
+		policy.apply(rc, u.log, release)
 	}
 }
 
-func handleSS(conn net.Conn, ciph core.Cipher) {
-	defer conn.Close()
+// countSSHandshakeFailure records a failed Shadowsocks handshake, keeping
+// replays apart from everything else.
+func countSSHandshakeFailure(err error) {
+	reason := "invalid"
+	if errors.Is(err, errReplayedSalt) || errors.Is(err, errSS2022Replay) {
+		reason = "replay"
+	}
+	countHandshakeFailure("ss", reason)
+}
 
-	ssConn := ciph.StreamConn(conn)
+// serveSSStream reads the target address from an already-wrapped Shadowsocks
+// stream and relays it. conn is the raw connection underneath ssConn and must
+// be a *recordConn or wrap one. It returns an error only if the handshake
+// failed, in which case nothing has been sent to the client yet.
+func serveSSStream(conn, ssConn net.Conn, u *ssUser) error {
 	tgt, err := socks.ReadAddr(ssConn)
 	if err != nil {
-		return
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	stopRecording(conn)
+
+	remote, err := u.out.Dial(tgt.String())
+	var denied *aclDeniedError
+	if errors.As(err, &denied) {
+		u.log.Warn("destination denied", logRemote, conn.RemoteAddr().String(), logTarget, tgt.String(), "rule", denied.rule)
+		countACLDenied("ss", denied)
+		return nil
 	}
-
-	remote, err := net.DialTimeout("tcp", tgt.String(), 10*time.Second)
 	if err != nil {
-		return
+		u.log.Warn("dial failed", logRemote, conn.RemoteAddr().String(), logTarget, tgt.String(), "err", err)
+		countDialError(err)
+		return nil
 	}
 	defer remote.Close()
+	defer observeRelay("ss", time.Now())
 
-	bidirectionalRelayRW(conn, ssConn, remote)
+	bidirectionalRelayRW(conn, ssConn, remote, u.traffic)
+	return nil
 }
 
 // --- password persistence ---
 
-const passwordFile = "/etc/hidexx/passwords.json"
-
-func loadOrGeneratePasswords(n int) []string {
-	// 尝试从文件加载
-	if data, err := os.ReadFile(passwordFile); err == nil {
-		var existing []string
-		if json.Unmarshal(data, &existing) == nil {
-			if len(existing) >= n {
-				log.Printf("loaded %d passwords from %s", n, passwordFile)
-				return existing[:n]
-			}
-			// 已有密码不够，保留已有的，追加新的
-			log.Printf("loaded %d passwords, generating %d more", len(existing), n-len(existing))
-			for len(existing) < n {
-				existing = append(existing, generatePassword())
-			}
-			savePasswords(existing)
-			return existing
-		}
-	}
+// passwordFile is where users were kept before they had names: a JSON array
+// whose entry i was user i+1's password, "" for a revoked user.
+const passwordFile = "passwords.json"
 
-	// 全新生成
-	pws := make([]string, n)
-	for i := range pws {
-		pws[i] = generatePassword()
+// legacySSUsers reads passwordFile as registry entries user1, user2, ... on
+// the ports they were served on, or returns nil if there is none.
+func legacySSUsers(basePort int) []*userEntry {
+	path := statePath(passwordFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var passwords []string
+	if err := json.Unmarshal(data, &passwords); err != nil {
+		slog.Warn("ignoring unreadable passwords file", "path", path, "err", err)
+		return nil
+	}
+	users := make([]*userEntry, len(passwords))
+	for i, pw := range passwords {
+		users[i] = &userEntry{Name: fmt.Sprintf("user%d", i+1), Port: basePort + i, Password: pw}
+		if pw == "" {
+			disabled := false
+			users[i].Enabled = &disabled
+		}
 	}
-	savePasswords(pws)
-	return pws
+	return users
 }
 
-func generatePassword() string {
-	b := make([]byte, 32)
+// generatePassword returns a random base64 key sized for m. 2022 methods use
+// it as the raw PSK; legacy AEAD methods derive their key from it.
+func generatePassword(m *ssMethod) string {
+	b := make([]byte, m.KeySize)
 	if _, err := rand.Read(b); err != nil {
-		log.Fatalf("rand.Read failed: %v", err)
+		fatal("rand.Read failed", "err", err)
 	}
 	return base64.StdEncoding.EncodeToString(b)
 }
 
-func savePasswords(pws []string) {
-	os.MkdirAll(filepath.Dir(passwordFile), 0755)
-	data, err := json.Marshal(pws)
-	if err != nil {
-		log.Printf("marshal passwords failed: %v", err)
-		return
+const serverPSKFile = "server-psk.json"
+
+// loadOrGenerateServerPSK returns the server-wide identity PSK used by
+// single-port 2022 mode, keyed by method so switching methods keeps old keys.
+func loadOrGenerateServerPSK(m *ssMethod) []byte {
+	path := statePath(serverPSKFile)
+	keys := map[string]string{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			fatal("cannot parse server PSK file", "path", path, "err", err)
+		}
 	}
-	if err := os.WriteFile(passwordFile, data, 0600); err != nil {
-		log.Printf("save passwords failed: %v", err)
-		return
+	if encoded, ok := keys[m.Client]; ok {
+		psk, err := decodeSS2022Key(m, encoded)
+		if err != nil {
+			fatal("stored server PSK is not usable", "path", path, "err", err)
+		}
+		return psk
+	}
+
+	encoded := generatePassword(m)
+	keys[m.Client] = encoded
+	data, _ := json.Marshal(keys)
+	if err := writeFileAtomic(path, data); err != nil {
+		fatal("cannot save server PSK", "path", path, "err", err)
 	}
-	log.Printf("saved %d passwords to %s", len(pws), passwordFile)
+	psk, _ := base64.StdEncoding.DecodeString(encoded)
+	return psk
 }
@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"lukechampine.com/blake3"
+)
+
+// Shadowsocks 2022 (SIP022) constants.
+const (
+	ss2022SubkeyContext   = "shadowsocks 2022 session subkey"
+	ss2022IdentityContext = "shadowsocks 2022 identity subkey"
+
+	ss2022HeaderTypeClient = 0
+	ss2022HeaderTypeServer = 1
+
+	ss2022MaxTimeDiff  = 30 * time.Second // accepted clock skew for request timestamps
+	ss2022SaltLifetime = 60 * time.Second // how long a seen salt is remembered
+
+	ss2022TagSize        = 16
+	ss2022MaxPayloadSize = 0xFFFF
+	ss2022EIHSize        = aes.BlockSize
+)
+
+var (
+	errSS2022BadHeader = errors.New("ss2022: bad header")
+	errSS2022BadTime   = errors.New("ss2022: timestamp outside allowed window")
+	errSS2022Replay    = errors.New("ss2022: repeated salt")
+)
+
+// decodeSS2022Key decodes a base64 PSK and checks its length against the method.
+func decodeSS2022Key(m *ssMethod, password string) ([]byte, error) {
+	psk, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("%s needs a base64 key: %w", m.Client, err)
+	}
+	if len(psk) != m.KeySize {
+		return nil, fmt.Errorf("%s needs a %d-byte key, got %d bytes", m.Client, m.KeySize, len(psk))
+	}
+	return psk, nil
+}
+
+// ss2022SessionAEAD derives the AES-GCM AEAD for one direction of a session.
+func ss2022SessionAEAD(psk, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, ss2022SubkeyContext, append(append([]byte{}, psk...), salt...))
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ss2022UserHash is the EIH plaintext that identifies a user PSK.
+func ss2022UserHash(psk []byte) [ss2022EIHSize]byte {
+	var h [ss2022EIHSize]byte
+	sum := blake3.Sum256(psk)
+	copy(h[:], sum[:])
+	return h
+}
+
+// saltPool remembers recently seen salts so a recorded request cannot be replayed.
+type saltPool struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPurge time.Time
+}
+
+func newSaltPool() *saltPool {
+	return &saltPool{seen: make(map[string]time.Time)}
+}
+
+// Add records salt and reports whether it was new.
+func (p *saltPool) Add(salt []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.lastPurge) > time.Second {
+		for k, exp := range p.seen {
+			if now.After(exp) {
+				delete(p.seen, k)
+			}
+		}
+		p.lastPurge = now
+	}
+
+	if exp, ok := p.seen[string(salt)]; ok && now.Before(exp) {
+		return false
+	}
+	p.seen[string(salt)] = now.Add(ss2022SaltLifetime)
+	return true
+}
+
+// ss2022Cipher is the server side of a single-PSK Shadowsocks 2022 AES-GCM method.
+// It only handles TCP; SIP022 UDP uses a different packet format.
+type ss2022Cipher struct {
+	psk   []byte
+	salts *saltPool
+}
+
+func newSS2022Cipher(m *ssMethod, password string) (*ss2022Cipher, error) {
+	psk, err := decodeSS2022Key(m, password)
+	if err != nil {
+		return nil, err
+	}
+	return &ss2022Cipher{psk: psk, salts: newSaltPool()}, nil
+}
+
+func (c *ss2022Cipher) StreamConn(conn net.Conn) net.Conn {
+	return &ss2022Conn{Conn: conn, psk: c.psk, salts: c.salts}
+}
+
+// streamConnWithSalt is StreamConn for a request whose salt (and identity
+// header) has already been consumed while identifying the user.
+func (c *ss2022Cipher) streamConnWithSalt(conn net.Conn, salt []byte) net.Conn {
+	return &ss2022Conn{Conn: conn, psk: c.psk, salts: c.salts, reqSalt: salt}
+}
+
+// ss2022Conn decrypts a SIP022 request and encrypts the response. Reads start
+// with the SOCKS target address followed by the initial payload, so callers can
+// treat it like a legacy AEAD stream.
+type ss2022Conn struct {
+	net.Conn
+	psk   []byte
+	salts *saltPool
+
+	reqSalt  []byte
+	r        *ss2022Reader
+	leftover []byte
+
+	w *ss2022Writer
+}
+
+func (c *ss2022Conn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		if err := c.readRequestHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	return c.r.Read(b)
+}
+
+func (c *ss2022Conn) readRequestHeader() error {
+	keySize := len(c.psk)
+	if c.reqSalt == nil {
+		c.reqSalt = make([]byte, keySize)
+		if _, err := io.ReadFull(c.Conn, c.reqSalt); err != nil {
+			return err
+		}
+	}
+	aead, err := ss2022SessionAEAD(c.psk, c.reqSalt)
+	if err != nil {
+		return err
+	}
+	r := &ss2022Reader{Reader: c.Conn, aead: aead, nonce: make([]byte, aead.NonceSize())}
+
+	// fixed-length header: type | timestamp | length
+	fixed, err := r.open(1 + 8 + 2)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != ss2022HeaderTypeClient {
+		return errSS2022BadHeader
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(fixed[1:9])), 0)
+	if d := time.Since(ts); d > ss2022MaxTimeDiff || d < -ss2022MaxTimeDiff {
+		return errSS2022BadTime
+	}
+	if !c.salts.Add(c.reqSalt) {
+		return errSS2022Replay
+	}
+	length := int(binary.BigEndian.Uint16(fixed[9:11]))
+
+	// variable-length header: address | padding length | padding | initial payload
+	vh, err := r.open(length)
+	if err != nil {
+		return err
+	}
+	addr := socks.SplitAddr(vh)
+	if addr == nil || len(vh) < len(addr)+2 {
+		return errSS2022BadHeader
+	}
+	rest := vh[len(addr):]
+	padding := int(binary.BigEndian.Uint16(rest[:2]))
+	if len(rest) < 2+padding {
+		return errSS2022BadHeader
+	}
+	payload := rest[2+padding:]
+
+	c.leftover = append(append([]byte{}, addr...), payload...)
+	c.r = r
+	return nil
+}
+
+func (c *ss2022Conn) Write(b []byte) (int, error) {
+	if c.w == nil {
+		return c.writeResponseHeader(b)
+	}
+	return c.w.Write(b)
+}
+
+// writeResponseHeader sends salt | fixed header | first payload chunk, then
+// hands any remaining bytes to the regular chunk writer.
+func (c *ss2022Conn) writeResponseHeader(b []byte) (int, error) {
+	if c.reqSalt == nil {
+		return 0, errors.New("ss2022: response before request")
+	}
+	salt := make([]byte, len(c.psk))
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := ss2022SessionAEAD(c.psk, salt)
+	if err != nil {
+		return 0, err
+	}
+	w := &ss2022Writer{Writer: c.Conn, aead: aead, nonce: make([]byte, aead.NonceSize())}
+
+	first := b
+	if len(first) > ss2022MaxPayloadSize {
+		first = first[:ss2022MaxPayloadSize]
+	}
+
+	// fixed-length header: type | timestamp | request salt | length
+	fixed := make([]byte, 0, 1+8+len(c.reqSalt)+2)
+	fixed = append(fixed, ss2022HeaderTypeServer)
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+	fixed = append(fixed, c.reqSalt...)
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(first)))
+
+	buf := append([]byte{}, salt...)
+	buf = w.seal(buf, fixed)
+	buf = w.seal(buf, first)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	c.w = w
+
+	if len(first) == len(b) {
+		return len(b), nil
+	}
+	n, err := w.Write(b[len(first):])
+	return len(first) + n, err
+}
+
+// ss2022Reader reads length-prefixed AEAD chunks; unlike shadowaead it allows
+// 0xFFFF-byte payloads and shares its nonce counter with the request header.
+type ss2022Reader struct {
+	io.Reader
+	aead     cipher.AEAD
+	nonce    []byte
+	buf      []byte
+	leftover []byte
+}
+
+// open reads and decrypts one sealed chunk of n plaintext bytes.
+func (r *ss2022Reader) open(n int) ([]byte, error) {
+	if cap(r.buf) < n+ss2022TagSize {
+		r.buf = make([]byte, n+ss2022TagSize)
+	}
+	buf := r.buf[:n+ss2022TagSize]
+	if _, err := io.ReadFull(r.Reader, buf); err != nil {
+		return nil, err
+	}
+	p, err := r.aead.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	return p, err
+}
+
+func (r *ss2022Reader) Read(b []byte) (int, error) {
+	if len(r.leftover) == 0 {
+		lb, err := r.open(2)
+		if err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(lb))
+		p, err := r.open(size)
+		if err != nil {
+			return 0, err
+		}
+		r.leftover = p
+	}
+	n := copy(b, r.leftover)
+	r.leftover = r.leftover[n:]
+	return n, nil
+}
+
+// ss2022Writer writes length-prefixed AEAD chunks.
+type ss2022Writer struct {
+	io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func (w *ss2022Writer) seal(dst, plaintext []byte) []byte {
+	dst = w.aead.Seal(dst, w.nonce, plaintext, nil)
+	increment(w.nonce)
+	return dst
+}
+
+func (w *ss2022Writer) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > ss2022MaxPayloadSize {
+			chunk = chunk[:ss2022MaxPayloadSize]
+		}
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(chunk)))
+		buf := make([]byte, 0, 2+len(chunk)+2*ss2022TagSize)
+		buf = w.seal(buf, size[:])
+		buf = w.seal(buf, chunk)
+		if _, err := w.Writer.Write(buf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// increment a little-endian nonce counter.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// identifySS2022User reads the salt and extensible identity header (EIH) of a
+// multi-user request and returns the matching user's decrypting stream.
+func identifySS2022User(conn net.Conn, serverPSK []byte, users []*ssUser) (*ssUser, net.Conn, error) {
+	head := make([]byte, len(serverPSK)+ss2022EIHSize)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, nil, err
+	}
+	salt, eih := head[:len(serverPSK)], head[len(serverPSK):]
+
+	identityKey := make([]byte, len(serverPSK))
+	blake3.DeriveKey(identityKey, ss2022IdentityContext, append(append([]byte{}, serverPSK...), salt...))
+	block, err := aes.NewCipher(identityKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	var hash [ss2022EIHSize]byte
+	block.Decrypt(hash[:], eih)
+
+	for _, u := range users {
+		if u.psk != nil && ss2022UserHash(u.psk) == hash {
+			return u, u.ciph.(*ss2022Cipher).streamConnWithSalt(conn, salt), nil
+		}
+	}
+	return nil, nil, errors.New("no user matches identity header")
+}
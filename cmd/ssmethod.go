@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// ssMethod maps a go-shadowsocks2 cipher name to the name clients use.
+type ssMethod struct {
+	Name    string // go-shadowsocks2 name, e.g. AEAD_AES_256_GCM
+	Client  string // Clash "cipher" and SIP002 method, e.g. aes-256-gcm
+	KeySize int
+	SIP022  bool // Shadowsocks 2022: password is a base64 key of KeySize bytes
+}
+
+// defaultSSMethod is ss's --method default. Passwords generated outside ss
+// are keyed for it, so ss can serve the same registry.
+const defaultSSMethod = "AEAD_AES_256_GCM"
+
+var ssMethods = []*ssMethod{
+	{Name: "AEAD_AES_128_GCM", Client: "aes-128-gcm", KeySize: 16},
+	{Name: "AEAD_AES_256_GCM", Client: "aes-256-gcm", KeySize: 32},
+	{Name: "AEAD_CHACHA20_POLY1305", Client: "chacha20-ietf-poly1305", KeySize: 32},
+	{Name: "2022-blake3-aes-128-gcm", Client: "2022-blake3-aes-128-gcm", KeySize: 16, SIP022: true},
+	{Name: "2022-blake3-aes-256-gcm", Client: "2022-blake3-aes-256-gcm", KeySize: 32, SIP022: true},
+}
+
+// lookupSSMethod accepts either the server or the client spelling of a method.
+func lookupSSMethod(name string) (*ssMethod, error) {
+	for _, m := range ssMethods {
+		if strings.EqualFold(name, m.Name) || strings.EqualFold(name, m.Client) {
+			return m, nil
+		}
+	}
+	names := make([]string, len(ssMethods))
+	for i, m := range ssMethods {
+		names[i] = m.Client
+	}
+	return nil, fmt.Errorf("unsupported method %q (supported: %s)", name, strings.Join(names, ", "))
+}
+
+// UDP reports whether the server relays UDP for this method.
+func (m *ssMethod) UDP() bool { return !m.SIP022 }
+
+// pickCipher builds the server-side cipher for one user's password.
+func (m *ssMethod) pickCipher(password string) (core.StreamConnCipher, error) {
+	if m.SIP022 {
+		return newSS2022Cipher(m, password)
+	}
+	return core.PickCipher(m.Name, nil, password)
+}
+
+// URL returns a SIP002 ss:// link. AEAD userinfo is base64url without padding;
+// 2022 methods must use plain method:password with the password percent-encoded.
+// plugin is the SIP003 "name;opts" string, or empty.
+func (m *ssMethod) URL(password, host string, port int, plugin, tag string) string {
+	userinfo := base64.RawURLEncoding.EncodeToString([]byte(m.Client + ":" + password))
+	if m.SIP022 {
+		userinfo = m.Client + ":" + url.QueryEscape(password)
+	}
+	query := ""
+	if plugin != "" {
+		query = "/?plugin=" + url.QueryEscape(plugin)
+	}
+	return fmt.Sprintf("ss://%s@%s%s#%s", userinfo, net.JoinHostPort(host, strconv.Itoa(port)), query, url.PathEscape(tag))
+}
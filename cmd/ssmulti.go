@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+const ssHandshakeTimeout = 10 * time.Second
+
+// ssUser is one Shadowsocks account and the state shared by its connections.
+type ssUser struct {
+	name    string
+	ciph    core.StreamConnCipher
+	aead    shadowaead.Cipher // legacy AEAD methods
+	salts   *saltFilter       // legacy AEAD methods; 2022 ciphers check replays themselves
+	psk     []byte            // 2022 methods
+	traffic *userTraffic
+	conns   *userConns
+	live    *liveConns // open connections, closed when the user is removed
+	out     *egress
+	log     *slog.Logger
+}
+
+func newSSUser(name string, ciph core.StreamConnCipher, traffic *userTraffic, conns *userConns) (*ssUser, error) {
+	u := &ssUser{name: name, ciph: ciph, traffic: traffic, conns: conns, log: userLog(name)}
+	switch c := ciph.(type) {
+	case *ss2022Cipher:
+		u.psk = c.psk
+		return u, nil
+	case shadowaead.Cipher:
+		u.aead, u.salts = c, newSaltFilter()
+		return u, nil
+	}
+	return nil, errors.New("need an AEAD or 2022 cipher")
+}
+
+// prefixConn replays bytes that were already read from Conn before reading further.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newPrefixConn(c net.Conn, prefix []byte) *prefixConn {
+	return &prefixConn{Conn: c, r: io.MultiReader(bytes.NewReader(prefix), c)}
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// identifySSUser reads the salt and the first encrypted length chunk of a
+// stream and returns the user whose key opens it, together with that user's
+// decrypting stream. All users must share one cipher method.
+func identifySSUser(conn net.Conn, users []*ssUser) (*ssUser, net.Conn, error) {
+	if len(users) == 0 {
+		return nil, nil, errors.New("no users to identify")
+	}
+	saltSize := users[0].aead.SaltSize()
+	head := make([]byte, saltSize+2+16) // salt | AEAD(len) ; both GCM and Poly1305 have 16-byte tags
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, nil, err
+	}
+
+	salt, chunk := head[:saltSize], head[saltSize:]
+	var zeroNonce [12]byte
+	buf := make([]byte, 0, 2)
+	for _, u := range users {
+		aead, err := u.aead.Decrypter(salt)
+		if err != nil {
+			continue
+		}
+		if _, err := aead.Open(buf, zeroNonce[:aead.NonceSize()], chunk, nil); err == nil {
+			return u, u.salts.guard(u.ciph.StreamConn(newPrefixConn(conn, head)), salt, u.name), nil
+		}
+	}
+	return nil, nil, errors.New("no user key matches")
+}
+
+// startSSMulti serves every user from a single TCP+UDP port. Legacy AEAD users
+// are told apart by which key decrypts the first chunk; 2022 users by the
+// identity header encrypted with serverPSK. users returns the current user
+// set, so it can change while the port is open.
+func startSSMulti(port int, users func() []*ssUser, serverPSK []byte, opts *ssOptions) {
+	m, policy := opts.method, opts.policy
+	lg := slog.With(logListener, "shared")
+	ln, err := listenSS(opts.lc, port, opts.plugin, lg)
+	if err != nil {
+		fatal("listen failed", logListener, "shared", "port", port, "err", err)
+	}
+	lg.Info("Shadowsocks listening", "method", m.Client, "addr", ln.Addr().String(), "users", len(users()))
+	shared := opts.limits.Shared()
+
+	identify := func(conn net.Conn) (*ssUser, net.Conn, error) {
+		return identifySSUser(conn, users())
+	}
+	if m.SIP022 {
+		identify = func(conn net.Conn) (*ssUser, net.Conn, error) {
+			return identifySS2022User(conn, serverPSK, users())
+		}
+	}
+
+	if m.UDP() {
+		go startSSMultiUDP(opts.lc, port, users, opts.guard)
+	} else {
+		lg.Info("UDP relay not available", "method", m.Client)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if opts.lc.Stopping() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			lg.Warn("accept failed", "err", err)
+			continue
+		}
+		if !opts.guard.Admit(port, conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		remote := conn.RemoteAddr().String()
+		if !shared.Acquire(remote) {
+			conn.Close()
+			continue
+		}
+		opts.lc.Go(conn, func() {
+			defer conn.Close()
+			held := shared
+			release := func() {
+				held.Release()
+				held = nil
+			}
+			defer release()
+
+			rc := newRecordConn(conn)
+			rc.SetReadDeadline(time.Now().Add(ssHandshakeTimeout))
+
+			u, ssConn, err := identify(rc)
+			if err != nil {
+				lg.Info("unidentified client", logRemote, remote, "err", err)
+				countHandshakeFailure("ss", "unidentified")
+				opts.guard.Fail(conn.RemoteAddr(), "ss")
+				policy.apply(rc, lg, release)
+				return
+			}
+			// Trade the anonymous slot for one counted against the user.
+			held.Release()
+			if held = u.conns; u.traffic.OverQuota() || !held.Acquire(remote) {
+				held = nil
+				return
+			}
+			if !u.live.Add(conn) {
+				return
+			}
+			defer u.live.Remove(conn)
+			if err := serveSSStream(rc, ssConn, u); err != nil {
+				countSSHandshakeFailure(err)
+				opts.guard.Fail(conn.RemoteAddr(), "ss")
+				policy.apply(rc, u.log, release)
+			}
+		})
+	}
+}
+
+// multiUserPacketConn decrypts each packet with whichever user's key opens it
+// and encrypts replies with the key last used by that client address.
+type multiUserPacketConn struct {
+	net.PacketConn
+	users func() []*ssUser
+
+	mu      sync.Mutex
+	clients map[string]*ssUser
+}
+
+func (c *multiUserPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pkt := make([]byte, udpBufSize)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(pkt)
+		if err != nil {
+			return 0, addr, err
+		}
+		for _, u := range c.users() {
+			p, err := shadowaead.Unpack(b, pkt[:n], u.aead)
+			if err != nil {
+				continue
+			}
+			c.mu.Lock()
+			c.clients[addr.String()] = u
+			c.mu.Unlock()
+			return len(p), addr, nil
+		}
+	}
+}
+
+func (c *multiUserPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	u := c.userOf(addr)
+	if u == nil {
+		return 0, errors.New("unknown client address")
+	}
+	buf := make([]byte, u.aead.SaltSize()+len(b)+16)
+	pkt, err := shadowaead.Pack(buf, b, u.aead)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(pkt, addr)
+	return len(b), err
+}
+
+func (c *multiUserPacketConn) userOf(addr net.Addr) *ssUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clients[addr.String()]
+}
+
+func (c *multiUserPacketConn) forget(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.clients, addr.String())
+}
+
+func startSSMultiUDP(lc *lifecycle, port int, users func() []*ssUser, guard *clientGuard) {
+	addr := "0.0.0.0:" + strconv.Itoa(port)
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		fatal("UDP listen failed", logListener, "shared", "addr", addr, "err", err)
+	}
+	lc.AddCloser(c)
+	slog.Info("Shadowsocks UDP listening", logListener, "shared", "addr", addr)
+
+	mc := &multiUserPacketConn{PacketConn: c, users: users, clients: make(map[string]*ssUser)}
+	userOf := func(addr net.Addr) *ssUser {
+		if !guard.Allowed(port, addr) {
+			return nil
+		}
+		return mc.userOf(addr)
+	}
+	serveSSUDP(mc, userOf, mc.forget)
+}
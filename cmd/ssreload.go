@@ -0,0 +1,470 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// ssServer owns the set of Shadowsocks users being served and can change it
+// while running. Users are added and removed by starting and stopping their
+// listeners (or, on a single port, by changing who can be identified), and a
+// removed user's open connections are closed. A new password or method only
+// applies to new connections.
+type ssServer struct {
+	opts       *ssOptions
+	basePort   int
+	singlePort bool
+	serverPSK  []byte // single-port 2022 methods
+
+	mu    sync.Mutex
+	slots map[string]*ssSlot    // by user name
+	live  map[string]*liveConns // by user name, kept across key changes
+	order []string              // served names, in registry order
+
+	shared atomic.Pointer[[]*ssUser] // single-port mode: users to try, in order
+}
+
+// ssSlot is one served user.
+type ssSlot struct {
+	port     int
+	password string
+	method   *ssMethod
+	user     atomic.Pointer[ssUser] // read by the accept loop for each connection
+
+	// per-port mode
+	ln  net.Listener
+	udp net.PacketConn
+}
+
+func newSSServer(opts *ssOptions, basePort int, singlePort bool) *ssServer {
+	s := &ssServer{opts: opts, basePort: basePort, singlePort: singlePort, slots: make(map[string]*ssSlot), live: make(map[string]*liveConns)}
+	s.shared.Store(&[]*ssUser{})
+	if singlePort && opts.method.SIP022 {
+		s.serverPSK = loadOrGenerateServerPSK(opts.method)
+	}
+	return s
+}
+
+// port is the port a user connects to.
+func (s *ssServer) port(e *userEntry) int {
+	if s.singlePort {
+		return s.basePort
+	}
+	return e.Port
+}
+
+// method is the cipher a user is served with. Users of a single port are
+// told apart by trying their keys, so they must all use --method.
+func (s *ssServer) method(e *userEntry) (*ssMethod, error) {
+	if e.Method == "" {
+		return s.opts.method, nil
+	}
+	m, err := lookupSSMethod(e.Method)
+	if err != nil {
+		return nil, err
+	}
+	if s.singlePort && m != s.opts.method {
+		return nil, fmt.Errorf("method %s differs from --method %s, which every user of a single port must use", m.Client, s.opts.method.Client)
+	}
+	return m, nil
+}
+
+// clientPassword is what a user's client config needs. Multi-user 2022
+// clients send the server PSK in an identity header, so they need both keys.
+func (s *ssServer) clientPassword(password string) string {
+	if s.serverPSK == nil {
+		return password
+	}
+	return base64.StdEncoding.EncodeToString(s.serverPSK) + ":" + password
+}
+
+func (s *ssServer) sharedUsers() []*ssUser {
+	return *s.shared.Load()
+}
+
+// prepare fills in the ports and passwords the registry leaves out and
+// saves it if anything was added.
+func (s *ssServer) prepare(r *userRegistry) error {
+	changed := r.assignPorts(s.basePort)
+	if r.fillPasswords(s.opts.method) {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return r.Save()
+}
+
+// start begins serving the enabled users of r and, in single-port mode,
+// opens the port.
+func (s *ssServer) start(r *userRegistry) error {
+	if err := s.apply(r.Enabled()); err != nil {
+		return err
+	}
+	if s.singlePort {
+		go startSSMulti(s.basePort, s.sharedUsers, s.serverPSK, s.opts)
+	}
+	return nil
+}
+
+// apply makes the served users match users. Users that cannot be served are
+// reported in the returned error and left as they were.
+func (s *ssServer) apply(users []*userEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want := make(map[string]bool, len(users))
+	for _, e := range users {
+		want[e.Name] = true
+	}
+	for name := range s.slots {
+		if !want[name] {
+			s.removeUser(name)
+		}
+	}
+
+	var errs []error
+	for _, e := range users {
+		slot, ok := s.slots[e.Name]
+		var err error
+		switch {
+		case !ok:
+			err = s.addUser(e)
+		case slot.port != s.port(e):
+			// Open connections outlive a move to another port.
+			delete(s.slots, e.Name)
+			s.closeSlot(slot)
+			err = s.addUser(e)
+		default:
+			err = s.updateUser(e, slot)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %s: %w", e.Name, err))
+		}
+	}
+
+	s.order = s.order[:0]
+	shared := make([]*ssUser, 0, len(users))
+	for _, e := range users {
+		if slot, ok := s.slots[e.Name]; ok {
+			s.order = append(s.order, e.Name)
+			shared = append(shared, slot.user.Load())
+		}
+	}
+	if s.singlePort {
+		s.shared.Store(&shared)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *ssServer) newUser(e *userEntry, m *ssMethod) (*ssUser, error) {
+	ciph, err := m.pickCipher(e.Password)
+	if err != nil {
+		return nil, err
+	}
+	traffic := s.opts.traffic.User(e.Name)
+	traffic.SetQuota(e.QuotaBytes(s.opts.traffic.quota))
+	u, err := newSSUser(e.Name, ciph, traffic, s.opts.limits.User(e.Name))
+	if err != nil {
+		return nil, err
+	}
+	if u.out, err = newEgress(s.opts.acl.Port(s.port(e)), s.opts.upstreams, e.Upstream); err != nil {
+		return nil, err
+	}
+	u.live = s.live[e.Name]
+	if u.live == nil {
+		u.live = newLiveConns()
+		s.live[e.Name] = u.live
+	}
+	return u, nil
+}
+
+// addUser starts serving a new user. Callers hold s.mu.
+func (s *ssServer) addUser(e *userEntry) error {
+	m, err := s.method(e)
+	if err != nil {
+		return err
+	}
+	u, err := s.newUser(e, m)
+	if err != nil {
+		return err
+	}
+	slot := &ssSlot{port: s.port(e), password: e.Password, method: m}
+	slot.user.Store(u)
+
+	if !s.singlePort {
+		if err := s.listenPort(slot); err != nil {
+			return err
+		}
+	}
+	s.slots[e.Name] = slot
+	u.log.Info("user added")
+	return nil
+}
+
+// removeUser stops serving a user and closes their open connections, so a
+// revoked or disabled user is cut off at once. Callers hold s.mu.
+func (s *ssServer) removeUser(name string) {
+	slot := s.slots[name]
+	delete(s.slots, name)
+	s.closeSlot(slot)
+	n := s.live[name].CloseAll()
+	delete(s.live, name)
+	slot.user.Load().log.Info("user removed", "closed_connections", n)
+}
+
+// closeSlot closes a slot's own listeners, if any.
+func (s *ssServer) closeSlot(slot *ssSlot) {
+	if slot.ln != nil {
+		slot.ln.Close()
+		s.opts.lc.RemoveCloser(slot.ln)
+	}
+	if slot.udp != nil {
+		slot.udp.Close()
+		s.opts.lc.RemoveCloser(slot.udp)
+	}
+}
+
+// updateUser applies a changed password, method or quota to a served user.
+// TCP connections already open keep the old key; the UDP socket is reopened
+// with the new one. Callers hold s.mu.
+func (s *ssServer) updateUser(e *userEntry, slot *ssSlot) error {
+	m, err := s.method(e)
+	if err != nil {
+		return err
+	}
+	if slot.password == e.Password && slot.method == m {
+		slot.user.Load().traffic.SetQuota(e.QuotaBytes(s.opts.traffic.quota))
+		return nil
+	}
+	u, err := s.newUser(e, m)
+	if err != nil {
+		return err
+	}
+	slot.password, slot.method = e.Password, m
+	slot.user.Store(u)
+	if !s.singlePort {
+		if slot.udp != nil {
+			slot.udp.Close()
+			s.opts.lc.RemoveCloser(slot.udp)
+			slot.udp = nil
+		}
+		s.listenPortUDP(slot)
+	}
+	u.log.Info("user key changed", "method", m.Client)
+	return nil
+}
+
+// listenPort opens a user's own TCP (and UDP) port.
+func (s *ssServer) listenPort(slot *ssSlot) error {
+	u := slot.user.Load()
+	ln, err := listenSS(s.opts.lc, slot.port, s.opts.plugin, u.log)
+	if err != nil {
+		return explainPortInUse(err)
+	}
+	u.log.Info("Shadowsocks listening", "method", slot.method.Client, "addr", ln.Addr().String())
+	slot.ln = ln
+	s.listenPortUDP(slot)
+	go s.acceptPort(ln, slot)
+	return nil
+}
+
+func (s *ssServer) listenPortUDP(slot *ssSlot) {
+	u := slot.user.Load()
+	pc, ok := u.ciph.(core.PacketConnCipher)
+	if !ok || !slot.method.UDP() {
+		u.log.Info("UDP relay not available", "method", slot.method.Client)
+		return
+	}
+	c, err := listenSSUDP(s.opts.lc, slot.port, u, pc, s.opts.guard)
+	if err != nil {
+		u.log.Error("UDP listen failed", "port", slot.port, "err", err)
+		return
+	}
+	slot.udp = c
+}
+
+// acceptPort serves one user's port until its listener is closed.
+func (s *ssServer) acceptPort(ln net.Listener, slot *ssSlot) {
+	opts := s.opts
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if opts.lc.Stopping() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slot.user.Load().log.Warn("accept failed", "err", err)
+			continue
+		}
+		if !opts.guard.Admit(slot.port, conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		u := slot.user.Load()
+		if u.traffic.OverQuota() || !u.conns.Acquire(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		if !u.live.Add(conn) {
+			u.conns.Release()
+			conn.Close()
+			continue
+		}
+		opts.lc.Go(conn, func() {
+			release := sync.OnceFunc(u.conns.Release)
+			defer release()
+			defer u.live.Remove(conn)
+			handleSS(conn, u, opts.policy, opts.guard, release)
+		})
+	}
+}
+
+// liveConns tracks one user's open connections so they can be closed when
+// the user is removed. A nil *liveConns tracks nothing.
+type liveConns struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newLiveConns() *liveConns {
+	return &liveConns{conns: make(map[net.Conn]struct{})}
+}
+
+// Add tracks conn. It reports false once CloseAll has run: the user is gone
+// and conn must not be served.
+func (l *liveConns) Add(conn net.Conn) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+// Remove stops tracking a connection that has ended.
+func (l *liveConns) Remove(conn net.Conn) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+}
+
+// CloseAll closes every tracked connection and refuses new ones. It returns
+// how many were closed.
+func (l *liveConns) CloseAll() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	n := len(l.conns)
+	for c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+	return n
+}
+
+// ssUserInfo is what the banner and subscription handler need about a user.
+type ssUserInfo struct {
+	Name     string
+	Port     int
+	Method   *ssMethod
+	Password string // as the client needs it
+}
+
+func (s *ssServer) info(name string, slot *ssSlot) ssUserInfo {
+	return ssUserInfo{Name: name, Port: slot.port, Method: slot.method, Password: s.clientPassword(slot.password)}
+}
+
+// Users lists the users currently served, in registry order.
+func (s *ssServer) Users() []ssUserInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ssUserInfo, 0, len(s.order))
+	for _, name := range s.order {
+		out = append(out, s.info(name, s.slots[name]))
+	}
+	return out
+}
+
+// User returns one served user.
+func (s *ssServer) User(name string) (ssUserInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot, ok := s.slots[name]
+	if !ok {
+		return ssUserInfo{}, false
+	}
+	return s.info(name, slot), true
+}
+
+// clashHandler serves /NAME/clash.yaml for whichever users exist at request
+// time. /N/clash.yaml links from before users had names still reach userN.
+func (s *ssServer) clashHandler(clashYAML func(ssUserInfo) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/clash.yaml")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		info, ok := s.User(name)
+		if n, err := strconv.Atoi(name); !ok && err == nil {
+			info, ok = s.User("user" + strconv.Itoa(n))
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		countSubscriptionRequest(info.Name, r.UserAgent())
+		w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+		w.Write([]byte(clashYAML(info)))
+	}
+}
+
+// reload re-reads the user registry and applies it.
+func (s *ssServer) reload(reason string) {
+	path := statePath(usersFile)
+	unlock, err := lockUsers()
+	if err != nil {
+		slog.Error("reload failed", "reason", reason, "path", path, "err", err)
+		return
+	}
+	r, err := loadUserRegistry(path)
+	if err == nil {
+		err = s.prepare(r)
+	}
+	unlock()
+	if err != nil {
+		slog.Error("reload failed", "reason", reason, "path", path, "err", err)
+		return
+	}
+	slog.Info("reloading users", "reason", reason, "path", path)
+	if err := s.apply(r.Enabled()); err != nil {
+		slog.Error("reload incomplete", "err", err)
+	}
+}
+
+// watchUsers reloads on SIGHUP and whenever the user registry changes, until
+// lc shuts down.
+func (s *ssServer) watchUsers(lc *lifecycle) {
+	watchFile(lc, statePath(usersFile), "users", s.reload)
+}
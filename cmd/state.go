@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/liao/hidexx/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// stateDir holds everything the servers persist: users, keys and usage
+// counters. It is set by setupState before any command runs.
+var stateDir string
+
+func init() {
+	rootCmd.PersistentFlags().String("state-dir", "", "directory for users, keys and usage (env HIDEXX_STATE_DIR, config state_dir; default "+config.DefaultStateDir()+")")
+	_ = viper.BindPFlag("state_dir", rootCmd.PersistentFlags().Lookup("state-dir"))
+}
+
+// setupState resolves stateDir from the flag, environment or config file.
+func setupState(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	stateDir, err = filepath.Abs(cfg.StateDir)
+	if err != nil {
+		return fmt.Errorf("--state-dir: %w", err)
+	}
+	return nil
+}
+
+// statePath returns the path of a file in the state directory.
+func statePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
+
+// checkStateDir makes sure the state directory exists and is writable, so a
+// server fails at startup instead of handing out secrets it cannot keep.
+func checkStateDir() error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(stateDir, ".write-test-*")
+	if err != nil {
+		return fmt.Errorf("state directory %s is not writable: %w", stateDir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// writeFileAtomic replaces path with data, readable only by the owner. The
+// data goes to a temporary file in the same directory which is then renamed
+// over path, so readers and a crash mid-write never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
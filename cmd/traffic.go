@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Quota periods.
+const (
+	quotaDaily   = "daily"
+	quotaMonthly = "monthly"
+)
+
+// trafficSaveInterval is how often usage counters are written to disk.
+const trafficSaveInterval = time.Minute
+
+// Traffic directions, as seen from the user.
+const (
+	trafficUp   = iota // client -> target
+	trafficDown        // target -> client
+)
+
+func addTrafficFlags(cmd *cobra.Command) {
+	cmd.Flags().String("rate", "0", "per-user rate limit in bytes/s for each direction, e.g. 2M (0 = unlimited)")
+	cmd.Flags().String("quota", "0", "per-user transfer quota per period, e.g. 100G (0 = unlimited)")
+	cmd.Flags().String("quota-period", quotaMonthly, "quota reset period: daily or monthly")
+}
+
+// trafficStoreFromFlags builds the usage store for a command from its flags.
+func trafficStoreFromFlags(cmd *cobra.Command, name string) (*trafficStore, error) {
+	rateStr, _ := cmd.Flags().GetString("rate")
+	quotaStr, _ := cmd.Flags().GetString("quota")
+	period, _ := cmd.Flags().GetString("quota-period")
+
+	rate, err := parseByteSize(rateStr)
+	if err != nil {
+		return nil, fmt.Errorf("--rate: %w", err)
+	}
+	quota, err := parseByteSize(quotaStr)
+	if err != nil {
+		return nil, fmt.Errorf("--quota: %w", err)
+	}
+	if period != quotaDaily && period != quotaMonthly {
+		return nil, fmt.Errorf("--quota-period: want %s or %s, got %q", quotaDaily, quotaMonthly, period)
+	}
+	return newTrafficStore(statePath("usage-"+name+".json"), rate, quota, period)
+}
+
+// parseByteSize parses sizes like "512", "64K", "2M", "1.5G" or "1T" (powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// formatByteSize is the inverse of parseByteSize, for logs.
+func formatByteSize(n int64) string {
+	const units = "KMGT"
+	v, i := float64(n), -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i < 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%cB", v, units[i])
+}
+
+// tokenBucket is a simple rate limiter. Callers take what they need and sleep
+// off any deficit, so a single large read cannot exceed the long-run rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate { // burst of one second
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// Wait takes n tokens, blocking until the bucket can afford them.
+func (b *tokenBucket) Wait(n int) {
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / b.rate * float64(time.Second)))
+	}
+}
+
+// Allow takes n tokens only if they are available now.
+func (b *tokenBucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// trafficUsage is what gets persisted for each user.
+type trafficUsage struct {
+	Period string `json:"period"` // e.g. "2026-10" or "2026-10-17"
+	Up     int64  `json:"up"`
+	Down   int64  `json:"down"`
+}
+
+// userTraffic counts one user's bytes for the current quota period and
+// applies their rate limit. A nil *userTraffic counts nothing.
+type userTraffic struct {
+	name  string
+	store *trafficStore
+	limit [2]*tokenBucket // by direction; nil when unlimited
+	bytes [2]*counter     // by direction, for /metrics
+
+	mu sync.Mutex
+	trafficUsage
+	quota     int64 // 0 = unlimited
+	overQuota bool
+}
+
+// Limited reports whether a rate limit applies, i.e. whether relays must see
+// every chunk rather than letting the kernel splice.
+func (t *userTraffic) Limited() bool {
+	return t != nil && t.limit[trafficUp] != nil
+}
+
+// Transfer records n bytes in direction dir, first waiting for the rate limit.
+func (t *userTraffic) Transfer(dir, n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+	if b := t.limit[dir]; b != nil {
+		b.Wait(n)
+	}
+	t.add(dir, n)
+}
+
+// AllowPacket records a UDP packet of n bytes, or reports false if it should
+// be dropped because of the rate limit or quota.
+func (t *userTraffic) AllowPacket(dir, n int) bool {
+	if t == nil {
+		return true
+	}
+	if t.OverQuota() {
+		return false
+	}
+	if b := t.limit[dir]; b != nil && !b.Allow(n) {
+		return false
+	}
+	t.add(dir, n)
+	return true
+}
+
+func (t *userTraffic) add(dir, n int) {
+	t.bytes[dir].Add(int64(n))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollover()
+	if dir == trafficUp {
+		t.Up += int64(n)
+	} else {
+		t.Down += int64(n)
+	}
+	if q := t.quota; q > 0 && !t.overQuota && t.Up+t.Down >= q {
+		t.overQuota = true
+		userLog(t.name).Warn("quota reached, refusing new connections until it resets",
+			"quota", formatByteSize(q), "period", t.Period, logBytes, t.Up+t.Down)
+		go t.store.Save()
+	}
+}
+
+// rollover resets the counters when a new quota period starts. Callers hold t.mu.
+func (t *userTraffic) rollover() {
+	if p := t.store.currentPeriod(); p != t.Period {
+		t.Period, t.Up, t.Down, t.overQuota = p, 0, 0, false
+	}
+}
+
+// SetQuota changes the user's quota for the current and later periods.
+func (t *userTraffic) SetQuota(q int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollover()
+	t.quota = q
+	t.overQuota = q > 0 && t.Up+t.Down >= q
+}
+
+// OverQuota reports whether the user has used up this period's quota.
+func (t *userTraffic) OverQuota() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollover()
+	return t.overQuota
+}
+
+// trafficStore holds the per-user counters of one command and persists them
+// so quotas survive restarts.
+type trafficStore struct {
+	path   string
+	rate   int64
+	quota  int64
+	period string
+
+	mu    sync.Mutex
+	users map[string]*userTraffic
+}
+
+func newTrafficStore(path string, rate, quota int64, period string) (*trafficStore, error) {
+	s := &trafficStore{path: path, rate: rate, quota: quota, period: period, users: make(map[string]*userTraffic)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var saved map[string]trafficUsage
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for name, u := range saved {
+			if n, err := strconv.Atoi(name); err == nil {
+				name = "user" + strconv.Itoa(n) // saved before users had names
+			}
+			s.users[name] = s.setup(name, u)
+		}
+	}
+
+	return s, nil
+}
+
+// saveEvery saves s every trafficSaveInterval until ctx is cancelled. Run it
+// with lifecycle.Run, so shutdown waits for a save in progress before the
+// final one.
+func (s *trafficStore) saveEvery(ctx context.Context) {
+	tick := time.NewTicker(trafficSaveInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			saveTraffic(s)
+		}
+	}
+}
+
+func (s *trafficStore) setup(name string, u trafficUsage) *userTraffic {
+	t := &userTraffic{name: name, store: s, trafficUsage: u, quota: s.quota}
+	t.bytes[trafficUp] = metricBytes.With(name, "up")
+	t.bytes[trafficDown] = metricBytes.With(name, "down")
+	if s.rate > 0 {
+		t.limit = [2]*tokenBucket{newTokenBucket(s.rate), newTokenBucket(s.rate)}
+	}
+	t.mu.Lock()
+	t.rollover()
+	t.overQuota = t.quota > 0 && t.Up+t.Down >= t.quota
+	t.mu.Unlock()
+	return t
+}
+
+func (s *trafficStore) currentPeriod() string {
+	if s.period == quotaDaily {
+		return time.Now().Format("2006-01-02")
+	}
+	return time.Now().Format("2006-01")
+}
+
+// User returns the counters for the named user, creating them on first use.
+func (s *trafficStore) User(name string) *userTraffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.users[name]
+	if !ok {
+		t = s.setup(name, trafficUsage{})
+		s.users[name] = t
+	}
+	return t
+}
+
+// saveTraffic saves s, logging rather than returning failures.
+func saveTraffic(s *trafficStore) {
+	if err := s.Save(); err != nil {
+		slog.Error("save traffic usage failed", "path", s.path, "err", err)
+	}
+}
+
+// Save writes all counters to disk.
+func (s *trafficStore) Save() error {
+	s.mu.Lock()
+	out := make(map[string]trafficUsage, len(s.users))
+	for name, t := range s.users {
+		t.mu.Lock()
+		out[name] = t.trafficUsage
+		t.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
@@ -0,0 +1,334 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const udpBufSize = 64 * 1024
+
+// ssUDPTimeout is how long a Shadowsocks UDP NAT entry survives without traffic.
+// It is longer than relayIdleTimeout because UDP clients (DNS, QUIC, games)
+// often go quiet for a while and expect the mapping to still be there.
+const ssUDPTimeout = 5 * time.Minute
+
+// udpIdle tracks the last packet seen on a UDP session so several readers can
+// share one idle timeout, like relayIdleTimeout does for TCP relays.
+type udpIdle struct {
+	timeout time.Duration
+	last    atomic.Int64
+}
+
+func newUDPIdle(timeout time.Duration) *udpIdle {
+	u := &udpIdle{timeout: timeout}
+	u.touch()
+	return u
+}
+
+func (u *udpIdle) touch() { u.last.Store(time.Now().UnixNano()) }
+
+func (u *udpIdle) expired() bool {
+	return time.Since(time.Unix(0, u.last.Load())) > u.timeout
+}
+
+// readUDPWithIdle reads one packet from pc, extending the read deadline while
+// the session as a whole is still active. It returns an error once the session
+// has been idle for its timeout or the socket is closed.
+func readUDPWithIdle(pc net.PacketConn, buf []byte, idle *udpIdle) (int, net.Addr, error) {
+	for {
+		pc.SetReadDeadline(time.Now().Add(idle.timeout))
+		n, addr, err := pc.ReadFrom(buf)
+		if err == nil {
+			idle.touch()
+			return n, addr, nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && !idle.expired() {
+			continue
+		}
+		return 0, nil, err
+	}
+}
+
+// handleSOCKS5UDP serves a UDP ASSOCIATE request (RFC 1928 section 7) on an
+// already-negotiated control connection. The association lives until the
+// control connection closes or no packet has moved for relayIdleTimeout.
+//
+// The relay socket listens on all addresses and is announced as 0.0.0.0 with
+// its port, which clients take to mean the address they connected to: the
+// control connection's local address is not reachable from the client
+// behind NAT or a port forward.
+func handleSOCKS5UDP(conn net.Conn, user string, clientHint socks.Addr, t *userTraffic, out *egress) {
+	control, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		userLog(user).Warn("UDP associate over a non-TCP connection", logRemote, conn.RemoteAddr().String())
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	clientIP := control.IP
+
+	relay, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		userLog(user).Warn("UDP associate listen failed", logRemote, conn.RemoteAddr().String(), "err", err)
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer relay.Close()
+
+	outbound, err := net.ListenPacket("udp", "")
+	if err != nil {
+		userLog(user).Warn("UDP associate outbound failed", logRemote, conn.RemoteAddr().String(), "err", err)
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer outbound.Close()
+
+	bound := net.JoinHostPort("0.0.0.0", strconv.Itoa(relay.LocalAddr().(*net.UDPAddr).Port))
+	reply := append([]byte{0x05, 0x00, 0x00}, socks.ParseAddr(bound)...)
+	conn.Write(reply)
+	conn.SetDeadline(time.Time{})
+
+	// The client may announce the source port it will send from; 0 means "unknown".
+	var clientAddr atomic.Pointer[net.UDPAddr]
+	if hint, err := net.ResolveUDPAddr("udp", clientHint.String()); err == nil && hint.Port != 0 {
+		clientAddr.Store(&net.UDPAddr{IP: clientIP, Port: hint.Port})
+	}
+
+	idle := newUDPIdle(relayIdleTimeout)
+
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			conn.Close()
+			relay.Close()
+			outbound.Close()
+		})
+	}
+
+	// the association ends when the client closes the control connection
+	go func() {
+		io.Copy(io.Discard, conn)
+		closeAll()
+	}()
+
+	// target -> client
+	go func() {
+		defer closeAll()
+		buf := make([]byte, udpBufSize)
+		for {
+			n, src, err := readUDPWithIdle(outbound, buf, idle)
+			if err != nil {
+				return
+			}
+			dst := clientAddr.Load()
+			if dst == nil || !t.AllowPacket(trafficDown, n) {
+				continue
+			}
+			hdr := append([]byte{0, 0, 0}, socks.ParseAddr(src.String())...)
+			relay.WriteTo(append(hdr, buf[:n]...), dst)
+		}
+	}()
+
+	// client -> target
+	defer closeAll()
+	buf := make([]byte, udpBufSize)
+	for {
+		n, src, err := readUDPWithIdle(relay, buf, idle)
+		if err != nil {
+			return
+		}
+		from := src.(*net.UDPAddr)
+		if !from.IP.Equal(clientIP) {
+			continue
+		}
+		if dst := clientAddr.Load(); dst == nil {
+			clientAddr.Store(from)
+		} else if dst.Port != from.Port {
+			continue
+		}
+
+		// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA; fragmentation is not supported
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		tgt := socks.SplitAddr(buf[3:n])
+		if tgt == nil || !t.AllowPacket(trafficUp, n-3-len(tgt)) {
+			continue
+		}
+		tgtAddr, err := out.ResolveUDP(tgt.String())
+		if err != nil {
+			logUDPTargetError(userLog(user), "socks5", conn.RemoteAddr(), tgt.String(), err)
+			continue
+		}
+		outbound.WriteTo(buf[3+len(tgt):n], tgtAddr)
+	}
+}
+
+// logUDPTargetError reports a packet dropped because its target was refused
+// or could not be reached. This happens per packet, so only at debug level;
+// hidexx_acl_denied_total counts the refusals.
+func logUDPTargetError(lg *slog.Logger, proto string, remote net.Addr, target string, err error) {
+	var denied *aclDeniedError
+	if errors.As(err, &denied) {
+		countACLDenied(proto+"-udp", denied)
+		lg.Debug("UDP destination denied", logRemote, remote.String(), logTarget, target, "rule", denied.rule)
+		return
+	}
+	if errors.Is(err, errUDPUpstream) {
+		lg.Debug("UDP destination routed to an upstream", logRemote, remote.String(), logTarget, target)
+		return
+	}
+	lg.Debug("UDP resolve failed", logRemote, remote.String(), logTarget, target, "err", err)
+}
+
+// ssNATEntry is the outbound socket of one Shadowsocks client address. idle
+// is shared by both directions, so a client that only sends keeps it alive.
+type ssNATEntry struct {
+	pc   net.PacketConn
+	idle *udpIdle
+}
+
+// ssNATMap holds one outbound UDP socket per Shadowsocks client address.
+// Entries are used and closed under mu, so a packet is never written to a
+// socket that is being expired.
+type ssNATMap struct {
+	mu sync.Mutex
+	m  map[string]*ssNATEntry
+}
+
+func newSSNATMap() *ssNATMap {
+	return &ssNATMap{m: make(map[string]*ssNATEntry)}
+}
+
+// WriteTo sends b to addr through key's entry, creating it with open if
+// there is none yet. open starts whatever relays the entry's replies.
+func (nm *ssNATMap) WriteTo(key string, b []byte, addr net.Addr, open func() (*ssNATEntry, error)) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	e := nm.m[key]
+	if e == nil {
+		var err error
+		if e, err = open(); err != nil {
+			return err
+		}
+		nm.m[key] = e
+	}
+	e.idle.touch()
+	_, err := e.pc.WriteTo(b, addr)
+	return err
+}
+
+// Close removes e from key and closes its socket.
+func (nm *ssNATMap) Close(key string, e *ssNATEntry) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.m[key] == e {
+		delete(nm.m, key)
+	}
+	e.pc.Close()
+}
+
+// listenSSUDP serves Shadowsocks UDP for u on the same port as the TCP
+// listener, until the returned socket is closed. Packets from clients guard
+// does not allow are dropped.
+func listenSSUDP(lc *lifecycle, port int, u *ssUser, ciph core.PacketConnCipher, guard *clientGuard) (net.PacketConn, error) {
+	addr := "0.0.0.0:" + strconv.Itoa(port)
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	lc.AddCloser(c)
+	u.log.Info("Shadowsocks UDP listening", "addr", addr)
+
+	userOf := func(addr net.Addr) *ssUser {
+		if !guard.Allowed(port, addr) {
+			return nil
+		}
+		return u
+	}
+	go serveSSUDP(ciph.PacketConn(c), userOf, nil)
+	return c, nil
+}
+
+// serveSSUDP relays decrypted packets from ssPC. Each client address gets its own
+// outbound socket, expired after ssUDPTimeout. userOf returns the user behind a
+// client address; onExpire, if set, runs when a NAT entry is dropped.
+func serveSSUDP(ssPC net.PacketConn, userOf func(net.Addr) *ssUser, onExpire func(net.Addr)) {
+	nm := newSSNATMap()
+	buf := make([]byte, udpBufSize)
+
+	for {
+		n, raddr, err := ssPC.ReadFrom(buf)
+		if err != nil {
+			// undecryptable or short packets are dropped silently
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		tgt := socks.SplitAddr(buf[:n])
+		if tgt == nil {
+			continue
+		}
+		u := userOf(raddr)
+		if u == nil || !u.traffic.AllowPacket(trafficUp, n-len(tgt)) {
+			continue
+		}
+		tgtAddr, err := u.out.ResolveUDP(tgt.String())
+		if err != nil {
+			logUDPTargetError(u.log, "ss", raddr, tgt.String(), err)
+			continue
+		}
+
+		key := raddr.String()
+		open := func() (*ssNATEntry, error) {
+			pc, err := net.ListenPacket("udp", "")
+			if err != nil {
+				u.log.Warn("UDP outbound failed", logRemote, raddr.String(), "err", err)
+				return nil, err
+			}
+			e := &ssNATEntry{pc: pc, idle: newUDPIdle(ssUDPTimeout)}
+			go func(raddr net.Addr) {
+				relaySSUDPReplies(ssPC, raddr, e, nm, key, u.traffic)
+				if onExpire != nil {
+					onExpire(raddr)
+				}
+			}(raddr)
+			return e, nil
+		}
+		nm.WriteTo(key, buf[len(tgt):n], tgtAddr, open)
+	}
+}
+
+// relaySSUDPReplies copies packets from a NAT entry's outbound socket back to
+// the client, prefixing each one with the sender address, until it idles out.
+func relaySSUDPReplies(ssPC net.PacketConn, client net.Addr, e *ssNATEntry, nm *ssNATMap, key string, t *userTraffic) {
+	defer nm.Close(key, e)
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, src, err := readUDPWithIdle(e.pc, buf[socks.MaxAddrLen:], e.idle)
+		if err != nil {
+			return
+		}
+		if !t.AllowPacket(trafficDown, n) {
+			continue
+		}
+		srcAddr := socks.ParseAddr(src.String())
+		start := socks.MaxAddrLen - len(srcAddr)
+		copy(buf[start:], srcAddr)
+		if _, err := ssPC.WriteTo(buf[start:socks.MaxAddrLen+n], client); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// upstreamDirect is the reserved upstream name for connecting directly.
+const upstreamDirect = "direct"
+
+func addUpstreamFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("upstream", nil, "upstream proxy NAME=URL that traffic can leave through: socks5://[user:pass@]host:port, http://[user:pass@]host:port or an ss:// link (repeatable)")
+	cmd.Flags().String("upstream-file", "", "Clash YAML whose ss, socks5 and http \"proxies\" are added as upstreams under their names (other nodes are skipped), e.g. a downloaded subscription")
+	cmd.Flags().StringArray("route", nil, "DEST=UPSTREAM: send destinations matching DEST (a domain, covering its subdomains, or a CIDR matched against IP destinations) through UPSTREAM or \"direct\"; first match wins (repeatable)")
+}
+
+// upstreamSetFromFlags builds a command's upstreams and destination routes
+// from its flags and --rules file. It returns nil if none are configured.
+func upstreamSetFromFlags(cmd *cobra.Command) (*upstreamSet, error) {
+	urls, _ := cmd.Flags().GetStringArray("upstream")
+	file, _ := cmd.Flags().GetString("upstream-file")
+	routes, _ := cmd.Flags().GetStringArray("route")
+	rulesPath, _ := cmd.Flags().GetString("rules")
+	if len(urls) == 0 && file == "" && len(routes) == 0 && rulesPath == "" {
+		return nil, nil
+	}
+
+	s := &upstreamSet{named: make(map[string]upstreamDialer), skipped: make(map[string]string)}
+	if file != "" {
+		if err := s.loadClashFile(file); err != nil {
+			return nil, err
+		}
+	}
+	for _, arg := range urls {
+		name, raw, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("--upstream %q: want NAME=URL", arg)
+		}
+		d, err := parseUpstreamURL(raw)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		if err := s.add(name, d); err != nil {
+			return nil, err
+		}
+	}
+	for _, arg := range routes {
+		dest, name, ok := strings.Cut(arg, "=")
+		if !ok || dest == "" || name == "" {
+			return nil, fmt.Errorf("--route %q: want DEST=UPSTREAM", arg)
+		}
+		if err := s.addRoute(dest, name); err != nil {
+			return nil, fmt.Errorf("--route %q: %w", arg, err)
+		}
+	}
+	if rulesPath != "" {
+		rules, err := newRuleSet(rulesPath, s.checkAction)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = rules
+	}
+	return s, nil
+}
+
+// upstreamDialer opens a TCP connection to target (host:port) through an
+// upstream proxy. The host is passed on unresolved.
+type upstreamDialer interface {
+	DialContext(ctx context.Context, target string) (net.Conn, error)
+}
+
+// upstreamSet holds the named upstreams of a command and the rules that
+// pick between them: --route entries first, then the --rules file.
+type upstreamSet struct {
+	named   map[string]upstreamDialer
+	skipped map[string]string // --upstream-file proxies that cannot be used, and why
+	routes  []routeRule
+	rules   *ruleSet // nil without --rules
+}
+
+func (s *upstreamSet) add(name string, d upstreamDialer) error {
+	if name == upstreamDirect {
+		return fmt.Errorf("upstream name %q is reserved", name)
+	}
+	if _, ok := s.named[name]; ok {
+		return fmt.Errorf("upstream %s defined twice", name)
+	}
+	s.named[name] = d
+	return nil
+}
+
+// addRoute adds a --route entry as a DOMAIN-SUFFIX rule, or an IP-CIDR rule
+// that does not resolve domains.
+func (s *upstreamSet) addRoute(dest, name string) error {
+	if err := s.checkAction(ruleAction(name)); err != nil {
+		return err
+	}
+	nets, domains, err := parseACLEntries([]string{dest})
+	if err != nil {
+		return err
+	}
+	r := routeRule{action: ruleAction(name)}
+	switch {
+	case len(nets) == 1:
+		r.kind, r.prefix, r.noResolve = "IP-CIDR", nets[0], true
+	case len(domains) == 1:
+		r.kind, r.domain = "DOMAIN-SUFFIX", domains[0]
+	default:
+		return errors.New("empty destination")
+	}
+	s.routes = append(s.routes, r)
+	return nil
+}
+
+// checkAction reports an error if a rule action names no upstream.
+func (s *upstreamSet) checkAction(action string) error {
+	if action == ruleReject {
+		return nil
+	}
+	return s.Check(action)
+}
+
+// WatchRules reloads the --rules file as it changes, until lc shuts down.
+func (s *upstreamSet) WatchRules(lc *lifecycle) {
+	if s != nil && s.rules != nil {
+		s.rules.watch(lc)
+	}
+}
+
+// Check reports an error if name is neither an upstream nor "direct".
+func (s *upstreamSet) Check(name string) error {
+	if name == "" || name == upstreamDirect {
+		return nil
+	}
+	if s == nil {
+		return fmt.Errorf("no upstream %q (define it with --upstream)", name)
+	}
+	if _, ok := s.named[name]; ok {
+		return nil
+	}
+	if reason, ok := s.skipped[name]; ok {
+		return fmt.Errorf("upstream %q from --upstream-file cannot be used: %s", name, reason)
+	}
+	return fmt.Errorf("no upstream %q", name)
+}
+
+// pick returns the upstream for target: the action of the first matching
+// rule, else fallback. It returns "" and nil for a direct connection, and an
+// *aclDeniedError for a destination a rule rejects.
+func (s *upstreamSet) pick(ctx context.Context, fallback, target string) (string, upstreamDialer, error) {
+	if s == nil {
+		return "", nil, nil
+	}
+	t, err := newRuleTarget(target)
+	if err != nil {
+		return "", nil, err
+	}
+	name, ok := matchRules(ctx, s.routes, t)
+	if !ok {
+		name, ok = matchRules(ctx, s.rules.Rules(), t)
+	}
+	if !ok {
+		name = fallback
+	}
+	switch name {
+	case "", upstreamDirect:
+		return "", nil, nil
+	case ruleReject:
+		return "", nil, &aclDeniedError{target: target, rule: ruleReject}
+	}
+	return name, s.named[name], nil
+}
+
+// egress is how one user's connections leave the server: the destination
+// ACL of their port, and the upstreams to use for them. A nil *egress dials
+// everything directly.
+type egress struct {
+	acl       *destPolicy
+	upstreams *upstreamSet
+	upstream  string // the user's own upstream, "" = direct
+}
+
+// newEgress combines acl and upstreams for a user whose own upstream is
+// upstream ("" or "direct" to connect directly unless a route says otherwise).
+func newEgress(acl *destPolicy, upstreams *upstreamSet, upstream string) (*egress, error) {
+	if err := upstreams.Check(upstream); err != nil {
+		return nil, err
+	}
+	return &egress{acl: acl, upstreams: upstreams, upstream: upstream}, nil
+}
+
+// route returns the upstream target should go through, or nil to connect
+// directly.
+func (e *egress) route(ctx context.Context, target string) (string, upstreamDialer, error) {
+	if e == nil {
+		return "", nil, nil
+	}
+	return e.upstreams.pick(ctx, e.upstream, target)
+}
+
+// Dial checks target against the ACL and connects to it, directly or through
+// the upstream its route selects. Refusals by the ACL or a REJECT rule are
+// *aclDeniedError.
+func (e *egress) Dial(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	var acl *destPolicy
+	if e != nil {
+		acl = e.acl
+	}
+	name, up, err := e.route(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if up == nil {
+		addr, err := acl.Check(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	// The upstream resolves the name; only rules that can be decided
+	// without a lookup apply.
+	if err := acl.CheckName(target); err != nil {
+		return nil, err
+	}
+	conn, err := up.DialContext(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", name, err)
+	}
+	return conn, nil
+}
+
+// errUDPUpstream is returned for UDP destinations routed to an upstream:
+// upstreams only carry TCP, and sending the packets directly instead would
+// leak them past the upstream.
+var errUDPUpstream = errors.New("UDP is not relayed through upstreams")
+
+// ResolveUDP checks target against the ACL and resolves it for sending.
+func (e *egress) ResolveUDP(target string) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	_, up, err := e.route(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if up != nil {
+		return nil, errUDPUpstream
+	}
+	var acl *destPolicy
+	if e != nil {
+		acl = e.acl
+	}
+	addr, err := acl.Check(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+// parseUpstreamURL parses an --upstream URL.
+func parseUpstreamURL(raw string) (upstreamDialer, error) {
+	if strings.HasPrefix(raw, "ss://") {
+		return parseSSUpstreamURL(raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%s: missing port", redactURL(raw))
+	}
+	user, pass := "", ""
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return newSOCKS5Upstream(u.Host, user, pass)
+	case "http":
+		return &httpUpstream{addr: u.Host, user: user, password: pass}, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream scheme %q (want socks5, http or ss)", u.Scheme)
+}
+
+// parseSSUpstreamURL parses a SIP002 link: base64 method:password userinfo,
+// or plain method:password as 2022 links write it.
+func parseSSUpstreamURL(raw string) (upstreamDialer, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("invalid ss:// link")
+	}
+	if u.User == nil || u.Port() == "" {
+		return nil, errors.New("ss:// link needs method, password, host and port")
+	}
+	if u.Query().Get("plugin") != "" {
+		return nil, errors.New("ss:// upstreams with a plugin are not supported")
+	}
+	method, password := u.User.Username(), ""
+	if p, ok := u.User.Password(); ok {
+		password = p
+	} else {
+		enc := strings.TrimRight(method, "=")
+		dec, err := base64.RawURLEncoding.DecodeString(enc)
+		if err != nil {
+			dec, err = base64.RawStdEncoding.DecodeString(enc)
+		}
+		if err != nil {
+			return nil, errors.New("ss:// link: undecodable userinfo")
+		}
+		method, password, _ = strings.Cut(string(dec), ":")
+	}
+	return newSSUpstream(u.Host, method, password)
+}
+
+// clashUpstreams is the part of a Clash config read by --upstream-file.
+type clashUpstreams struct {
+	Proxies []struct {
+		Name     string `yaml:"name"`
+		Type     string `yaml:"type"`
+		Server   string `yaml:"server"`
+		Port     int    `yaml:"port"`
+		Cipher   string `yaml:"cipher"`
+		Password string `yaml:"password"`
+		Username string `yaml:"username"`
+		Plugin   string `yaml:"plugin"`
+		TLS      bool   `yaml:"tls"`
+	} `yaml:"proxies"`
+}
+
+// loadClashFile adds the proxies of a Clash config. Proxies hidexx cannot
+// dial (vmess, trojan, TLS, plugins) are skipped with a warning and recorded,
+// so Check can say why a route or user naming one is refused.
+func (s *upstreamSet) loadClashFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg clashUpstreams
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, p := range cfg.Proxies {
+		addr := net.JoinHostPort(p.Server, strconv.Itoa(p.Port))
+		var d upstreamDialer
+		switch {
+		case p.Plugin != "" || p.TLS:
+			err = errors.New("plugins and TLS are not supported")
+		case p.Type == "ss":
+			d, err = newSSUpstream(addr, p.Cipher, p.Password)
+		case p.Type == "socks5":
+			d, err = newSOCKS5Upstream(addr, p.Username, p.Password)
+		case p.Type == "http":
+			d = &httpUpstream{addr: addr, user: p.Username, password: p.Password}
+		default:
+			err = fmt.Errorf("unsupported type %q", p.Type)
+		}
+		// Subscriptions mix in node types this server cannot dial; skip
+		// them and let Check complain if a route or user names one.
+		if err != nil {
+			slog.Warn("skipping upstream", "path", path, "proxy", p.Name, "err", err)
+			s.skipped[p.Name] = err.Error()
+			continue
+		}
+		if err := s.add(p.Name, d); err != nil {
+			return fmt.Errorf("%s: proxy %q: %w", path, p.Name, err)
+		}
+		delete(s.skipped, p.Name)
+	}
+	return nil
+}
+
+// ssUpstream is a Shadowsocks server with a legacy AEAD method.
+type ssUpstream struct {
+	addr string
+	ciph core.StreamConnCipher
+}
+
+func newSSUpstream(addr, method, password string) (*ssUpstream, error) {
+	m, err := lookupSSMethod(method)
+	if err != nil {
+		return nil, err
+	}
+	if m.SIP022 {
+		return nil, fmt.Errorf("%s is not supported for upstreams", m.Client)
+	}
+	ciph, err := core.PickCipher(m.Name, nil, password)
+	if err != nil {
+		return nil, err
+	}
+	return &ssUpstream{addr: addr, ciph: ciph}, nil
+}
+
+func (u *ssUpstream) DialContext(ctx context.Context, target string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	sc := u.ciph.StreamConn(conn)
+	if _, err := sc.Write(socks.ParseAddr(target)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// socks5Upstream is a SOCKS5 server, with RFC 1929 auth if user is set.
+type socks5Upstream struct {
+	addr     string
+	user     string
+	password string
+}
+
+func newSOCKS5Upstream(addr, user, password string) (*socks5Upstream, error) {
+	if len(user) > 255 || len(password) > 255 {
+		return nil, errors.New("SOCKS5 username and password must be at most 255 bytes")
+	}
+	return &socks5Upstream{addr: addr, user: user, password: password}, nil
+}
+
+func (u *socks5Upstream) DialContext(ctx context.Context, target string) (net.Conn, error) {
+	tgt := socks.ParseAddr(target)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid target %q", target)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := u.handshake(conn, tgt); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (u *socks5Upstream) handshake(conn net.Conn, tgt socks.Addr) error {
+	method := byte(socks5MethodNoAuth)
+	if u.user != "" {
+		method = socks5MethodUserPass
+	}
+	if _, err := conn.Write([]byte{0x05, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0x05 || buf[1] != method {
+		return errors.New("SOCKS5 upstream refused the auth method")
+	}
+	if method == socks5MethodUserPass {
+		req := []byte{socks5UserPassVersion, byte(len(u.user))}
+		req = append(append(req, u.user...), byte(len(u.password)))
+		if _, err := conn.Write(append(req, u.password...)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != socks5UserPassOK {
+			return errors.New("SOCKS5 upstream rejected the credentials")
+		}
+	}
+
+	if _, err := conn.Write(append([]byte{0x05, socks.CmdConnect, 0x00}, tgt...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 upstream replied %d", reply[1])
+	}
+	_, err := socks.ReadAddr(conn) // bound address
+	return err
+}
+
+// httpUpstream is an HTTP proxy that supports CONNECT, with basic auth if
+// user is set.
+type httpUpstream struct {
+	addr     string
+	user     string
+	password string
+}
+
+func (u *httpUpstream) DialContext(ctx context.Context, target string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.user != "" {
+		req.SetBasicAuth(u.user, u.password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("HTTP upstream replied %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if n := br.Buffered(); n > 0 {
+		early, _ := br.Peek(n)
+		return newPrefixConn(conn, early), nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+)
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users served by ss and proxy",
+	Long: "Manage the users in users.json in the state directory. A running `hidexx ss` " +
+		"picks up changes immediately; proxy and serve read the file when they start.",
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add NAME",
+	Short: "Add a user with a generated password",
+	Args:  cobra.ExactArgs(1),
+	Run:   runUserAdd,
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users",
+	Args:  cobra.NoArgs,
+	Run:   runUserList,
+}
+
+var userRemoveCmd = &cobra.Command{
+	Use:   "remove NAME",
+	Short: "Remove a user",
+	Args:  cobra.ExactArgs(1),
+	Run:   runUserRemove,
+}
+
+var userRotateCmd = &cobra.Command{
+	Use:   "rotate NAME",
+	Short: "Give a user a new generated password",
+	Args:  cobra.ExactArgs(1),
+	Run:   runUserRotate,
+}
+
+var userShowCmd = &cobra.Command{
+	Use:   "show NAME",
+	Short: "Print a user's ss:// link, QR code and Clash subscription URL",
+	Args:  cobra.ExactArgs(1),
+	Run:   runUserShow,
+}
+
+func init() {
+	userCmd.PersistentFlags().Int("base-port", 51801, "starting port ss/proxy run with (their -p)")
+	userCmd.PersistentFlags().String("ss-method", defaultSSMethod, "method ss runs with (its -m), for users without their own")
+
+	userAddCmd.Flags().IntP("port", "p", 0, "the user's port (default: lowest free from --base-port)")
+	userAddCmd.Flags().StringP("method", "m", "", "the user's own encryption method (default: --ss-method)")
+	userAddCmd.Flags().String("quota", "", "the user's own transfer quota per period, e.g. 100G (default: ss/proxy --quota)")
+	userAddCmd.Flags().String("upstream", "", "send the user's traffic through this --upstream of ss/proxy")
+	userAddCmd.Flags().Bool("disabled", false, "add the user without serving them yet")
+
+	userShowCmd.Flags().String("host", "", "server address for the link (default: detected public IP)")
+	userShowCmd.Flags().String("http", "51800", "HTTP port of the ss Clash subscription server")
+	userShowCmd.Flags().Int("single-port", 0, "ss runs with --single-port on this port (0 = one port per user)")
+
+	userCmd.AddCommand(userAddCmd, userListCmd, userRemoveCmd, userRotateCmd, userShowCmd)
+	rootCmd.AddCommand(userCmd)
+}
+
+// loadUsersForEdit locks and loads the registry, migrating an old passwords
+// file the way ss would, so that editing before ss first runs does not orphan
+// it. Call unlock once any edit is saved.
+func loadUsersForEdit(cmd *cobra.Command) (users *userRegistry, unlock func()) {
+	basePort, _ := cmd.Flags().GetInt("base-port")
+	unlock, err := lockUsers()
+	if err != nil {
+		fatal("cannot lock users", "path", statePath(usersFile), "err", err)
+	}
+	users, err = loadOrCreateUsers(0, basePort, legacySSUsers(basePort))
+	if err != nil {
+		fatal("cannot load users", "path", statePath(usersFile), "err", err)
+	}
+	return users, unlock
+}
+
+// lookupUserOrExit returns the named user or exits with an error.
+func lookupUserOrExit(users *userRegistry, name string) *userEntry {
+	e := users.Lookup(name)
+	if e == nil {
+		fatal("no such user", logUser, name, "path", users.path)
+	}
+	return e
+}
+
+// userMethod is the method a user is served with.
+func userMethod(cmd *cobra.Command, e *userEntry) *ssMethod {
+	name := e.Method
+	if name == "" {
+		name, _ = cmd.Flags().GetString("ss-method")
+	}
+	m, err := lookupSSMethod(name)
+	if err != nil {
+		fatal("invalid method", logUser, e.Name, "err", err)
+	}
+	return m
+}
+
+// saveUsersOrExit validates and writes the registry.
+func saveUsersOrExit(users *userRegistry) {
+	err := users.validate()
+	if err == nil {
+		err = users.Save()
+	}
+	if err != nil {
+		fatal("cannot save users", "path", users.path, "err", err)
+	}
+}
+
+func runUserAdd(cmd *cobra.Command, args []string) {
+	name := args[0]
+	basePort, _ := cmd.Flags().GetInt("base-port")
+	port, _ := cmd.Flags().GetInt("port")
+	method, _ := cmd.Flags().GetString("method")
+	quota, _ := cmd.Flags().GetString("quota")
+	upstream, _ := cmd.Flags().GetString("upstream")
+	disabled, _ := cmd.Flags().GetBool("disabled")
+
+	if !userNameRE.MatchString(name) {
+		fatal("invalid user name: use 1-32 letters, digits, '.', '_' or '-'", logUser, name)
+	}
+	users, unlock := loadUsersForEdit(cmd)
+	defer unlock()
+	if users.Lookup(name) != nil {
+		fatal("user already exists", logUser, name, "path", users.path)
+	}
+	e := &userEntry{Name: name, Port: port, Method: method, Quota: quota, Upstream: upstream}
+	if disabled {
+		e.Enabled = new(bool)
+	}
+	users.Users = append(users.Users, e)
+	if err := users.validate(); err != nil {
+		fatal("invalid user", logUser, name, "err", err)
+	}
+	e.Password = generatePassword(userMethod(cmd, e))
+	users.assignPorts(basePort)
+	saveUsersOrExit(users)
+
+	fmt.Printf("added user %s on port %d\n", e.Name, e.Port)
+	fmt.Printf("run `hidexx user show %s` for the client link\n", e.Name)
+}
+
+func runUserList(cmd *cobra.Command, args []string) {
+	users, unlock := loadUsersForEdit(cmd)
+	unlock()
+	if len(users.Users) == 0 {
+		fmt.Printf("no users in %s\n", users.path)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPORT\tMETHOD\tQUOTA\tUPSTREAM\tENABLED")
+	for _, e := range users.Users {
+		method, quota, upstream := e.Method, e.Quota, e.Upstream
+		if method == "" {
+			method = "-"
+		}
+		if quota == "" {
+			quota = "-"
+		}
+		if upstream == "" {
+			upstream = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%t\n", e.Name, e.Port, method, quota, upstream, e.IsEnabled())
+	}
+	tw.Flush()
+}
+
+func runUserRemove(cmd *cobra.Command, args []string) {
+	users, unlock := loadUsersForEdit(cmd)
+	defer unlock()
+	lookupUserOrExit(users, args[0])
+	kept := users.Users[:0]
+	for _, e := range users.Users {
+		if e.Name != args[0] {
+			kept = append(kept, e)
+		}
+	}
+	users.Users = kept
+	saveUsersOrExit(users)
+	fmt.Printf("removed user %s\n", args[0])
+}
+
+func runUserRotate(cmd *cobra.Command, args []string) {
+	users, unlock := loadUsersForEdit(cmd)
+	defer unlock()
+	e := lookupUserOrExit(users, args[0])
+	e.Password = generatePassword(userMethod(cmd, e))
+	saveUsersOrExit(users)
+	fmt.Printf("new password set for %s; open connections keep the old one until they close\n", e.Name)
+	fmt.Printf("run `hidexx user show %s` for the new client link\n", e.Name)
+}
+
+func runUserShow(cmd *cobra.Command, args []string) {
+	host, _ := cmd.Flags().GetString("host")
+	httpPort, _ := cmd.Flags().GetString("http")
+	singlePort, _ := cmd.Flags().GetInt("single-port")
+
+	users, unlock := loadUsersForEdit(cmd)
+	unlock()
+	e := lookupUserOrExit(users, args[0])
+	if e.Password == "" {
+		fatal("user has no password yet; run `hidexx user rotate "+e.Name+"` or start ss", logUser, e.Name)
+	}
+	m := userMethod(cmd, e)
+	port, password := e.Port, e.Password
+	if singlePort != 0 {
+		port = singlePort
+		if m.SIP022 {
+			psk, err := readServerPSK(m)
+			if err != nil {
+				fatal("cannot read server PSK", "err", err)
+			}
+			password = psk + ":" + password
+		}
+	}
+	if host == "" {
+		host = getPublicIP()
+	}
+
+	link := m.URL(password, host, port, "", "hidexx-"+e.Name)
+	qr, err := qrcode.New(link, qrcode.Low)
+	if err != nil {
+		fatal("cannot make QR code", "err", err)
+	}
+
+	fmt.Printf("user %s", e.Name)
+	if !e.IsEnabled() {
+		fmt.Print(" (disabled)")
+	}
+	fmt.Println()
+	fmt.Println()
+	fmt.Printf("one-click URL: %s\n", link)
+	fmt.Println()
+	fmt.Print(qr.ToSmallString(false))
+	fmt.Println()
+	fmt.Printf("Clash subscription URL: http://%s:%s/%s/clash.yaml\n", host, httpPort, e.Name)
+	fmt.Println()
+	fmt.Println("(links for --plugin setups are printed by ss at startup)")
+}
+
+// readServerPSK returns the stored single-port server PSK for m as the
+// client writes it, without creating one.
+func readServerPSK(m *ssMethod) (string, error) {
+	path := statePath(serverPSKFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w (start ss with --single-port once to create it)", err)
+	}
+	keys := map[string]string{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return "", fmt.Errorf("parse %s: %w", path, err)
+	}
+	encoded, ok := keys[m.Client]
+	if !ok {
+		return "", fmt.Errorf("%s has no key for %s", path, m.Client)
+	}
+	psk, err := decodeSS2022Key(m, encoded)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(psk), nil
+}
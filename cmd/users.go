@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+// usersFile is the user registry shared by ss, proxy and serve, in the
+// state directory.
+const usersFile = "users.json"
+
+// explainPortInUse adds a hint to a listen error on a user's port: ss and
+// proxy both serve each user on the port stored in the registry, so they
+// cannot share one state directory on the same host.
+func explainPortInUse(err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("%w (ss and proxy serve users on the same ports from %s; run one of them with its own --state-dir)", err, usersFile)
+	}
+	return err
+}
+
+// userNameRE limits names to what is safe in URL paths, log fields, metric
+// labels and SOCKS5 usernames.
+var userNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`)
+
+// userEntry is one named user. Empty fields fall back to the command's
+// flags: the port to the next free one from --port, the method to --method,
+// the quota to --quota. The password is generated by ss, or by proxy without
+// --no-auth, when missing.
+// Upstream names one of the command's --upstream proxies to send the user's
+// traffic through.
+type userEntry struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port,omitempty"`
+	Password string `json:"password,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Quota    string `json:"quota,omitempty"` // e.g. "100G"
+	Upstream string `json:"upstream,omitempty"`
+	Enabled  *bool  `json:"enabled,omitempty"`
+}
+
+// IsEnabled reports whether the user should be served; entries without an
+// enabled field are.
+func (e *userEntry) IsEnabled() bool {
+	return e.Enabled == nil || *e.Enabled
+}
+
+// QuotaBytes returns the user's own quota, or def if none is set.
+func (e *userEntry) QuotaBytes(def int64) int64 {
+	if e.Quota == "" {
+		return def
+	}
+	q, _ := parseByteSize(e.Quota) // checked by validate
+	return q
+}
+
+// userRegistry is the list of named users, in file order.
+type userRegistry struct {
+	path  string
+	Users []*userEntry
+}
+
+// loadUserRegistry reads and checks the registry at path. A missing file is
+// reported with an error matching os.ErrNotExist.
+func loadUserRegistry(path string) (*userRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &userRegistry{path: path}
+	if err := json.Unmarshal(data, &r.Users); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// lockUsers takes an exclusive lock on the user registry until the returned
+// func is called. Whoever loads, edits and saves the registry holds it
+// throughout, so `hidexx user` and ss filling in passwords cannot overwrite
+// each other's changes.
+func lockUsers() (unlock func(), err error) {
+	path := statePath(usersFile + ".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// loadOrCreateUsers loads the registry, or creates it from legacy (the users of
+// an older per-command file) topped up to n users named user1, user2, ...
+// with ports counting up from basePort.
+func loadOrCreateUsers(n, basePort int, legacy []*userEntry) (*userRegistry, error) {
+	r, err := loadUserRegistry(statePath(usersFile))
+	if !errors.Is(err, os.ErrNotExist) {
+		return r, err
+	}
+	r = newUserRegistry(n, basePort, legacy)
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	if err := r.Save(); err != nil {
+		return nil, err
+	}
+	slog.Info("created user registry", "path", r.path, "users", len(r.Users), "migrated", len(legacy))
+	return r, nil
+}
+
+// newUserRegistry builds an unsaved registry the way loadOrCreateUsers
+// would create it.
+func newUserRegistry(n, basePort int, legacy []*userEntry) *userRegistry {
+	r := &userRegistry{path: statePath(usersFile), Users: legacy}
+	for i := len(r.Users); i < n; i++ {
+		e := &userEntry{Name: "user" + strconv.Itoa(i+1)}
+		if basePort > 0 {
+			e.Port = basePort + i
+		}
+		r.Users = append(r.Users, e)
+	}
+	return r
+}
+
+func (r *userRegistry) validate() error {
+	names := make(map[string]bool)
+	ports := make(map[int]string)
+	for i, e := range r.Users {
+		if e == nil || !userNameRE.MatchString(e.Name) {
+			return fmt.Errorf("entry %d: name must be 1-32 letters, digits, '.', '_' or '-'", i)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("user %s listed twice", e.Name)
+		}
+		names[e.Name] = true
+		if e.Port < 0 || e.Port > 65535 {
+			return fmt.Errorf("user %s: invalid port %d", e.Name, e.Port)
+		}
+		if other, ok := ports[e.Port]; ok && e.Port != 0 {
+			return fmt.Errorf("users %s and %s share port %d", other, e.Name, e.Port)
+		}
+		ports[e.Port] = e.Name
+		if e.Method != "" {
+			if _, err := lookupSSMethod(e.Method); err != nil {
+				return fmt.Errorf("user %s: %w", e.Name, err)
+			}
+		}
+		if e.Quota != "" {
+			if _, err := parseByteSize(e.Quota); err != nil {
+				return fmt.Errorf("user %s: quota: %w", e.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Lookup returns the named user, or nil.
+func (r *userRegistry) Lookup(name string) *userEntry {
+	for _, e := range r.Users {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Enabled returns the users to serve, in file order.
+func (r *userRegistry) Enabled() []*userEntry {
+	var out []*userEntry
+	for _, e := range r.Users {
+		if e.IsEnabled() {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// assignPorts gives every user without a port the lowest free one from
+// basePort up, and reports whether anything changed.
+func (r *userRegistry) assignPorts(basePort int) bool {
+	used := make(map[int]bool)
+	for _, e := range r.Users {
+		used[e.Port] = true
+	}
+	changed := false
+	next := basePort
+	for _, e := range r.Users {
+		if e.Port != 0 {
+			continue
+		}
+		for used[next] {
+			next++
+		}
+		e.Port, used[next] = next, true
+		changed = true
+	}
+	return changed
+}
+
+// fillPasswords generates a password for every user without one, keyed for
+// the user's method or def, and reports whether any was added.
+func (r *userRegistry) fillPasswords(def *ssMethod) bool {
+	changed := false
+	for _, e := range r.Users {
+		if e.Password != "" {
+			continue
+		}
+		m := def
+		if e.Method != "" {
+			m, _ = lookupSSMethod(e.Method) // checked by validate
+		}
+		e.Password = generatePassword(m)
+		changed = true
+		slog.Info("generated password", logUser, e.Name)
+	}
+	return changed
+}
+
+// Save writes the registry back to its file.
+func (r *userRegistry) Save() error {
+	data, err := json.MarshalIndent(r.Users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, append(data, '\n'))
+}
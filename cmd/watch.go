@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce collapses the burst of events an editor produces when
+// saving a watched file into a single reload.
+const reloadDebounce = 500 * time.Millisecond
+
+// watchFile calls reload on SIGHUP and whenever the file at path changes,
+// until lc shuts down. name describes the file in log messages. The directory
+// is watched rather than the file, because editors and atomic writers replace
+// the file instead of writing to it.
+func watchFile(lc *lifecycle, path, name string, reload func(reason string)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events <-chan fsnotify.Event
+	var watchErrs <-chan error
+	if w, err := fsnotify.NewWatcher(); err != nil {
+		slog.Warn("cannot watch "+name+" file, reload with SIGHUP", "err", err)
+	} else {
+		defer w.Close()
+		if err := w.Add(filepath.Dir(path)); err != nil {
+			slog.Warn("cannot watch "+name+" file, reload with SIGHUP", "path", path, "err", err)
+		} else {
+			events, watchErrs = w.Events, w.Errors
+		}
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-lc.Context().Done():
+			return
+		case <-hup:
+			reload("SIGHUP")
+		case ev := <-events:
+			if filepath.Clean(ev.Name) == path && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce = time.After(reloadDebounce)
+			}
+		case err := <-watchErrs:
+			slog.Warn(name+" file watch error", "err", err)
+		case <-debounce:
+			debounce = nil
+			reload("file changed")
+		}
+	}
+}
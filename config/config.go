@@ -12,12 +12,14 @@ type Config struct {
 	BaseURL  string `mapstructure:"base_url"`
 	Email    string `mapstructure:"email"`
 	Password string `mapstructure:"password"`
+	StateDir string `mapstructure:"state_dir"` // users, keys and usage counters
 }
 
 const defaultBaseURL = "https://a.hidexx.com"
 
 func Load() (*Config, error) {
 	viper.SetDefault("base_url", defaultBaseURL)
+	viper.SetDefault("state_dir", DefaultStateDir())
 
 	// 配置文件: ~/.hidexx.yaml
 	home, err := os.UserHomeDir()
@@ -50,6 +52,9 @@ func Load() (*Config, error) {
 	if cfg.BaseURL == "" {
 		cfg.BaseURL = defaultBaseURL
 	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = DefaultStateDir()
+	}
 
 	return &cfg, nil
 }
@@ -62,3 +67,19 @@ func ConfigFilePath() string {
 	}
 	return filepath.Join(home, ".hidexx.yaml")
 }
+
+// DefaultStateDir returns /etc/hidexx when running as root (the system
+// service layout), otherwise $XDG_STATE_HOME/hidexx or ~/.local/state/hidexx.
+func DefaultStateDir() string {
+	if os.Geteuid() == 0 {
+		return "/etc/hidexx"
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "hidexx")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".hidexx-state"
+	}
+	return filepath.Join(home, ".local", "state", "hidexx")
+}
@@ -97,16 +97,19 @@ echo ""
 echo "  Public IP: $PUBLIC_IP"
 echo ""
 echo "  --- crawled subscriptions (auto-renew daily) ---"
-echo "  user 1: http://$PUBLIC_IP:51991/1/sub.yaml"
-echo "  user 2: http://$PUBLIC_IP:51991/2/sub.yaml"
+echo "  user1: http://$PUBLIC_IP:51991/user1/sub.yaml"
+echo "  user2: http://$PUBLIC_IP:51991/user2/sub.yaml"
 echo ""
 echo "  --- Shadowsocks proxy (permanent) ---"
 echo "  Clash config:"
-echo "  user 1: http://$PUBLIC_IP:51800/1/clash.yaml"
-echo "  user 2: http://$PUBLIC_IP:51800/2/clash.yaml"
+echo "  user1: http://$PUBLIC_IP:51800/user1/clash.yaml"
+echo "  user2: http://$PUBLIC_IP:51800/user2/clash.yaml"
+echo "  (users are named in /etc/hidexx/users.json; rename or add them there)"
 echo ""
-echo "  SS one-click links:"
-sudo journalctl -u hidexx-ss --no-pager -n 20 2>/dev/null | grep "one-click" || cat /tmp/ss.log 2>/dev/null | grep "one-click" || echo "  (check: sudo journalctl -u hidexx-ss)"
+echo "  users:"
+sudo /usr/local/bin/hidexx user list
+echo "  SS one-click link + QR code: sudo hidexx user show <name>"
+echo "  add a user:                  sudo hidexx user add <name>"
 echo ""
 echo "  --- management ---"
 echo "  status:  sudo systemctl status hidexx-serve hidexx-ss"
@@ -114,5 +117,5 @@ echo "  logs:    sudo journalctl -fu hidexx-serve"
 echo "           sudo journalctl -fu hidexx-ss"
 echo "  restart: sudo systemctl restart hidexx-serve hidexx-ss"
 echo ""
-echo "  NOTE: open firewall ports 51800, 51801, 51802, 51991 (TCP)"
+echo "  NOTE: open firewall ports 51800, 51991 (TCP) and 51801, 51802 (TCP+UDP)"
 echo "=========================================="